@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Smet1/golang-proxy/internal/app/proxy"
+)
+
+// generateCA writes a new CA to the configured files unless they exist.
+func generateCA(args []string, log *logrus.Logger) error {
+	flags := flag.NewFlagSet("ca-generate", flag.ExitOnError)
+	configPath := flags.String("config", "./config.yaml", "path of proxy server config")
+	name := flags.String("name", hostname, "common name of the CA")
+	_ = flags.Parse(args)
+
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	err = proxy.WriteCA(config.Certificate, *name)
+	if err != nil {
+		return err
+	}
+	log.WithField("pem", config.Certificate.Pem).Info("CA generated")
+
+	return printFingerprint(config.Certificate)
+}
+
+// fingerprintCA prints digests of the configured CA certificate.
+func fingerprintCA(args []string, log *logrus.Logger) error {
+	flags := flag.NewFlagSet("ca-fingerprint", flag.ExitOnError)
+	configPath := flags.String("config", "./config.yaml", "path of proxy server config")
+	_ = flags.Parse(args)
+
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	return printFingerprint(config.Certificate)
+}
+
+// exportCA writes the configured CA in the requested format.
+func exportCA(args []string, log *logrus.Logger) error {
+	flags := flag.NewFlagSet("ca-export", flag.ExitOnError)
+	configPath := flags.String("config", "./config.yaml", "path of proxy server config")
+	format := flags.String("format", proxy.CAFormatPEM, "pem, der or p12 (certificate with key)")
+	password := flags.String("password", "", "password of p12 file")
+	out := flags.String("out", "", "output file, stdout by default")
+	_ = flags.Parse(args)
+
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	ca, err := loadCAFiles(config.Certificate)
+	if err != nil {
+		return err
+	}
+
+	data, err := proxy.ExportCA(ca, *format, *password)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	perm := os.FileMode(0644)
+	if *format == proxy.CAFormatPKCS12 {
+		perm = 0600
+	}
+	return errors.Wrap(ioutil.WriteFile(*out, data, perm), "can't write output file")
+}
+
+// rotateCA replaces the configured CA with a new one, keeping the old files
+// next to it.
+func rotateCA(args []string, log *logrus.Logger) error {
+	flags := flag.NewFlagSet("ca-rotate", flag.ExitOnError)
+	configPath := flags.String("config", "./config.yaml", "path of proxy server config")
+	name := flags.String("name", hostname, "common name of the new CA")
+	_ = flags.Parse(args)
+
+	config, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := proxy.RotateCA(config.Certificate, *name)
+	if err != nil {
+		return err
+	}
+	log.WithField("old", config.Certificate.Pem+suffix).Info("CA rotated")
+
+	return printFingerprint(config.Certificate)
+}
+
+// loadCAFiles reads the configured CA without generating a missing one.
+func loadCAFiles(c proxy.Certificate) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(c.Pem)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read CA certificate")
+	}
+	keyPEM, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read CA key")
+	}
+
+	return proxy.ParseCA(certPEM, keyPEM)
+}
+
+func printFingerprint(c proxy.Certificate) error {
+	ca, err := loadCAFiles(c)
+	if err != nil {
+		return err
+	}
+
+	sha256Hex, sha1Hex := proxy.Fingerprint(ca.Leaf)
+	fmt.Printf("subject: %s\nnot after: %s\nSHA-256: %s\nSHA-1: %s\n",
+		ca.Leaf.Subject, ca.Leaf.NotAfter.Format("2006-01-02"), sha256Hex, sha1Hex)
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Smet1/golang-proxy/internal/app/proxy"
+	proxy2 "github.com/Smet1/golang-proxy/internal/pkg/proxy"
+)
+
+// exportHAR writes saved requests selected by ids, host or time range as a
+// HAR document.
+func exportHAR(args []string, log *logrus.Logger) error {
+	flags := flag.NewFlagSet("export-har", flag.ExitOnError)
+	configPath := flags.String("config", "./config.yaml", "path of proxy server config")
+	ids := flags.String("ids", "", "comma separated ids of saved requests")
+	host := flags.String("host", "", "export requests to this host only")
+	from := flags.String("from", "", "export requests made since this RFC 3339 time")
+	to := flags.String("to", "", "export requests made before this RFC 3339 time")
+	out := flags.String("out", "", "output file, stdout by default")
+	_ = flags.Parse(args)
+
+	f := proxy2.Filter{Host: *host}
+	var err error
+	if *from != "" {
+		f.From, err = time.Parse(time.RFC3339, *from)
+		if err != nil {
+			return errors.Wrap(err, "can't parse from")
+		}
+	}
+	if *to != "" {
+		f.To, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			return errors.Wrap(err, "can't parse to")
+		}
+	}
+
+	store, err := openStore(*configPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	list, err := proxy2.SelectRequests(store, proxy2.SplitIDs(*ids), f)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, createErr := os.Create(*out)
+		if createErr != nil {
+			return errors.Wrap(createErr, "can't create output file")
+		}
+		defer file.Close()
+		w = file
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(proxy2.ToHAR(list))
+	if err != nil {
+		return errors.Wrap(err, "can't write har")
+	}
+
+	log.WithField("entries", len(list)).Info("exported")
+	return nil
+}
+
+// importHAR saves entries of a HAR file as imported requests.
+func importHAR(args []string, log *logrus.Logger) error {
+	flags := flag.NewFlagSet("import-har", flag.ExitOnError)
+	configPath := flags.String("config", "./config.yaml", "path of proxy server config")
+	in := flags.String("file", "", "HAR file to import")
+	_ = flags.Parse(args)
+
+	if *in == "" {
+		return errors.New("file is required")
+	}
+	file, err := os.Open(*in)
+	if err != nil {
+		return errors.Wrap(err, "can't open har file")
+	}
+	defer file.Close()
+
+	store, err := openStore(*configPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	ids, err := proxy2.ImportHAR(store, file)
+	log.WithField("imported", len(ids)).Info("imported")
+
+	return err
+}
+
+func openStore(configPath string) (proxy2.Store, error) {
+	config, err := readConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := proxy.Service{}
+	err = s.EnsureStore(&config.DB)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't ensure store")
+	}
+
+	return s.Store, nil
+}
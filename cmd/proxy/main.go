@@ -2,14 +2,10 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"flag"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"syscall"
 
 	proxy2 "github.com/Smet1/golang-proxy/internal/pkg/proxy"
@@ -20,18 +16,38 @@ import (
 
 	"github.com/Smet1/golang-proxy/internal/app/proxy"
 	"github.com/onrik/logrus/filename"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-var (
-	hostname, _ = os.Hostname()
+var hostname, _ = os.Hostname()
 
-	dir      = path.Join(os.Getenv("HOME"), "Desktop", "golang-proxy")
-	keyFile  = path.Join(dir, "ca-key.pem")
-	certFile = path.Join(dir, "ca-cert.pem")
-)
+var commands = map[string]func(args []string, log *logrus.Logger) error{
+	"export-har": exportHAR,
+	"import-har": importHAR,
+
+	"ca-generate":    generateCA,
+	"ca-fingerprint": fingerprintCA,
+	"ca-export":      exportCA,
+	"ca-rotate":      rotateCA,
+}
 
 func main() {
+	filenameHook := filename.NewHook()
+	filenameHook.Field = "sourcelog"
+
+	log := logrus.New()
+	log.AddHook(filenameHook)
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:], log); err != nil {
+				log.WithError(err).Fatalf("%s failed", os.Args[1])
+			}
+			return
+		}
+	}
+
 	configPath := flag.String(
 		"config",
 		"./config.yaml",
@@ -39,59 +55,93 @@ func main() {
 	)
 	flag.Parse()
 
-	filenameHook := filename.NewHook()
-	filenameHook.Field = "sourcelog"
-
-	log := logrus.New()
-	log.AddHook(filenameHook)
-
-	config := proxy.Config{}
-	err := configreader.ReadConfig(*configPath, &config)
+	config, err := readConfig(*configPath)
 	if err != nil {
 		log.WithError(err).Fatal("can't read config")
 	}
 
 	logrus.WithField("config", config).Info("started with data")
 
-	err = config.Validate()
+	ca, err := proxy.LoadCA(config.Certificate, hostname)
 	if err != nil {
-		log.WithError(err).Fatal("not valid config")
-	}
-
-	ca, err := loadCA()
-	if err != nil {
-		log.Fatal(err)
+		log.WithError(err).Fatal("can't load CA")
 	}
 	proxyService := proxy.Service{
 		Config: config,
-		CA:     &ca,
-		Client: httpclients.HTTPClient(),
+		CA:     ca,
 		Log:    log,
 	}
 
-	err = proxyService.EnsureDBConn(&config.DB)
+	err = proxyService.EnsureStore(&config.DB)
+	if err != nil {
+		log.WithError(err).Fatal("can't ensure store")
+	}
+	defer proxyService.Store.Close()
+
+	proxyService.Interceptor, err = proxy2.NewInterceptor(config.Intercept.Settings())
+	if err != nil {
+		log.WithError(err).Fatal("can't create interceptor")
+	}
+
+	proxyService.Rules, err = proxy2.NewRuleSet(config.Rules)
 	if err != nil {
-		log.WithError(err).Fatal("can't ensure db connection")
+		log.WithError(err).Fatal("can't create rules")
 	}
 
+	proxyService.Scope, err = proxy2.NewScope(config.Scope)
+	if err != nil {
+		log.WithError(err).Fatal("can't create scope")
+	}
+
+	proxyService.Passthrough, err = proxy2.NewPassthrough(config.Passthrough.Hosts, config.Passthrough.Auto)
+	if err != nil {
+		log.WithError(err).Fatal("can't create passthrough")
+	}
+
+	proxyService.WebSockets = proxy2.NewWebSockets()
+
+	proxyService.UpstreamTLS, err = proxy2.NewUpstreamTLS(config.UpstreamTLS, proxyService.TLSClientConfig)
+	if err != nil {
+		log.WithError(err).Fatal("can't create upstream tls")
+	}
+	proxyService.Client = httpclients.TLSHTTPClient(proxyService.UpstreamTLS.DialTLS)
+
 	proxyService.Wrap = func(upstream http.Handler) http.Handler {
 		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-			id := ""
-			if req.Method != http.MethodConnect {
-				id, err = proxy2.SaveRequest(req, proxyService.Collection)
-				if err != nil {
-					log.WithError(err).Error("can't save request")
-				}
-				log.WithFields(map[string]interface{}{
-					"id":     id,
-					"host":   req.Host,
-					"scheme": req.URL.Scheme,
-				}).Info("saved")
+			if req.Method == http.MethodConnect || !proxyService.Scope.InScope(proxy2.RequestTargetURL(req)) {
+				upstream.ServeHTTP(res, req)
+				return
 			}
 
-			upstream.ServeHTTP(res, req)
-			res.Header().Add("ID", id)
-			log.Println(req)
+			reqSave, err := proxy2.NewRequestSave(req)
+			if err != nil {
+				// the body is read partly, so it can't be sent on
+				proxy2.ErrResponse(res, http.StatusBadRequest, "can't read request")
+
+				log.WithError(err).Error("can't copy request")
+				return
+			}
+			if !proxyService.Intercept(res, req, reqSave) {
+				return
+			}
+			res.Header().Set("ID", reqSave.ID.Hex())
+			req = req.WithContext(proxy2.WithRequestSave(req.Context(), reqSave))
+
+			rec := proxy2.NewResponseRecorder(res)
+			upstream.ServeHTTP(rec, req)
+			reqSave.Response = rec.Response()
+
+			id, err := proxyService.Store.Save(reqSave)
+			if err != nil {
+				log.WithError(err).Error("can't save request")
+				return
+			}
+			log.WithFields(map[string]interface{}{
+				"id":     id,
+				"host":   req.Host,
+				"scheme": req.URL.Scheme,
+				"status": reqSave.Response.StatusCode,
+			}).Info("saved")
 		})
 	}
 
@@ -108,8 +158,15 @@ func main() {
 		}
 	}()
 
-	logrus.WithField("port", config.ServeAddrProxy).Info("proxy service started")
-	go log.Fatal(http.ListenAndServe(config.ServeAddrProxy, &proxyService))
+	go func() {
+		logrus.WithFields(logrus.Fields{
+			"port":     config.ServeAddrProxy,
+			"protocol": config.Protocol,
+		}).Info("proxy service started")
+		if err := proxyService.ListenAndServe(); err != nil {
+			log.Fatalf("proxy service, err: %s", err)
+		}
+	}()
 
 	sgnl := make(chan os.Signal, 1)
 	signal.Notify(sgnl,
@@ -126,33 +183,17 @@ func main() {
 	log.Printf("stopping, signal: %s", stop)
 }
 
-func loadCA() (cert tls.Certificate, err error) {
-	cert, err = tls.LoadX509KeyPair(certFile, keyFile)
-	if os.IsNotExist(err) {
-		cert, err = genCA()
-	}
-	if err == nil {
-		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-	}
-	return
-}
-
-func genCA() (cert tls.Certificate, err error) {
-	err = os.MkdirAll(dir, 0700)
-	if err != nil {
-		return
-	}
-	certPEM, keyPEM, err := proxy.GenCA(hostname)
+func readConfig(configPath string) (proxy.Config, error) {
+	config := proxy.Config{}
+	err := configreader.ReadConfig(configPath, &config)
 	if err != nil {
-		return
+		return config, err
 	}
-	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+
+	err = config.Validate()
 	if err != nil {
-		return cert, err
-	}
-	err = ioutil.WriteFile(certFile, certPEM, 0400)
-	if err == nil {
-		err = ioutil.WriteFile(keyFile, keyPEM, 0400)
+		return config, errors.Wrap(err, "not valid config")
 	}
-	return cert, err
+
+	return config, nil
 }
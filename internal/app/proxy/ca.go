@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Formats of the exported CA.
+const (
+	CAFormatPEM    = "pem"
+	CAFormatDER    = "der"
+	CAFormatPKCS12 = "p12"
+)
+
+// LoadCA reads the CA from the configured files. When neither exists a new
+// CA called name is generated there.
+func LoadCA(c Certificate, name string) (*tls.Certificate, error) {
+	_, certErr := os.Stat(c.Pem)
+	_, keyErr := os.Stat(c.Key)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		err := WriteCA(c, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certPEM, err := ioutil.ReadFile(c.Pem)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read CA certificate")
+	}
+	keyPEM, err := ioutil.ReadFile(c.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read CA key")
+	}
+
+	return ParseCA(certPEM, keyPEM)
+}
+
+// ParseCA parses a PEM certificate and its key in PKCS#1, PKCS#8 or EC form.
+func ParseCA(certPEM, keyPEM []byte) (*tls.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate in CA pem")
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse CA certificate")
+	}
+	if !leaf.IsCA {
+		return nil, errors.New("CA cert is not a CA")
+	}
+
+	key, err := ParsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if !samePublicKey(leaf.PublicKey, key.Public()) {
+		return nil, errors.New("CA key doesn't match the certificate")
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func samePublicKey(a, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(aDER, bDER)
+}
+
+// ParsePrivateKey parses the first private key block of keyPEM.
+func ParsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, keyPEM = pem.Decode(keyPEM)
+		if block == nil {
+			return nil, errors.New("no private key in pem")
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY", "ECDSA PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse %s", strings.ToLower(block.Type))
+		}
+
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key %T", key)
+		}
+
+		return signer, nil
+	}
+}
+
+// WriteCA generates a new CA and writes it to the configured files, which
+// must not exist. The files are written aside and renamed in place, so a
+// failed write doesn't leave a half written CA behind.
+func WriteCA(c Certificate, name string) error {
+	certPEM, keyPEM, err := GenCA(name, c.CAKeyType)
+	if err != nil {
+		return errors.Wrap(err, "can't generate CA")
+	}
+
+	for _, p := range []string{c.Pem, c.Key} {
+		err = os.MkdirAll(filepath.Dir(p), 0700)
+		if err != nil {
+			return errors.Wrap(err, "can't create CA dir")
+		}
+		_, err = os.Lstat(p)
+		if err == nil {
+			return errors.Errorf("CA file %s already exists", p)
+		}
+		if !os.IsNotExist(err) {
+			return errors.Wrap(err, "can't check CA file")
+		}
+	}
+
+	keyTmp, err := writeTemp(c.Key, keyPEM, 0400)
+	if err != nil {
+		return errors.Wrap(err, "can't write CA key")
+	}
+	defer os.Remove(keyTmp)
+	certTmp, err := writeTemp(c.Pem, certPEM, 0444)
+	if err != nil {
+		return errors.Wrap(err, "can't write CA certificate")
+	}
+	defer os.Remove(certTmp)
+
+	err = os.Rename(keyTmp, c.Key)
+	if err != nil {
+		return errors.Wrap(err, "can't write CA key")
+	}
+	err = os.Rename(certTmp, c.Pem)
+	if err != nil {
+		os.Remove(c.Key)
+		return errors.Wrap(err, "can't write CA certificate")
+	}
+
+	return nil
+}
+
+// writeTemp writes data to a temporary file next to path and returns its
+// name.
+func writeTemp(path string, data []byte, perm os.FileMode) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// RotateCA moves the current CA files aside with a time suffix and writes
+// a new CA in their place. It returns the suffix of the old files. When the
+// new CA can't be written, the old files are moved back.
+func RotateCA(c Certificate, name string) (string, error) {
+	suffix := "." + time.Now().UTC().Format("20060102T150405")
+	moved := make([]string, 0, 2)
+	restore := func() {
+		for _, p := range moved {
+			_ = os.Rename(p+suffix, p)
+		}
+	}
+	for _, p := range []string{c.Pem, c.Key} {
+		err := os.Rename(p, p+suffix)
+		if err == nil {
+			moved = append(moved, p)
+			continue
+		}
+		if !os.IsNotExist(err) {
+			restore()
+			return "", errors.Wrap(err, "can't move old CA")
+		}
+	}
+
+	if err := WriteCA(c, name); err != nil {
+		restore()
+		return "", err
+	}
+
+	return suffix, nil
+}
+
+// Fingerprint formats the SHA-256 and SHA-1 digests of the certificate as
+// browsers show them.
+func Fingerprint(cert *x509.Certificate) (sha256Hex, sha1Hex string) {
+	s256 := sha256.Sum256(cert.Raw)
+	s1 := sha1.Sum(cert.Raw)
+
+	return colonHex(s256[:]), colonHex(s1[:])
+}
+
+func colonHex(b []byte) string {
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = fmt.Sprintf("%02X", b[i])
+	}
+
+	return strings.Join(parts, ":")
+}
+
+// ExportCA encodes the CA certificate as PEM or DER, or the certificate
+// with its key as PKCS#12 protected by password.
+func ExportCA(ca *tls.Certificate, format, password string) ([]byte, error) {
+	switch format {
+	case CAFormatPEM:
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw}), nil
+	case CAFormatDER:
+		return ca.Leaf.Raw, nil
+	case CAFormatPKCS12:
+		data, err := pkcs12.Encode(rand.Reader, ca.PrivateKey, ca.Leaf, nil, password)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't encode pkcs12")
+		}
+		return data, nil
+	default:
+		return nil, errors.Errorf("unknown format %q", format)
+	}
+}
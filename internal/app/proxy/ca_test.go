@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseCAKeyFormats(t *testing.T) {
+	for _, keyType := range []string{KeyRSA2048, KeyECDSAP256, KeyEd25519} {
+		certPEM, keyPEM, err := GenCA("test CA", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := ParsePrivateKey(keyPEM)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, k := range [][]byte{keyPEM, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})} {
+			ca, err := ParseCA(certPEM, k)
+			if err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+			if _, err := genCert(ca, []string{"example.com"}, KeyECDSAP256); err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+		}
+	}
+}
+
+func TestParseCAKeyMismatch(t *testing.T) {
+	certPEM, _, err := GenCA("test CA", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyType := range []string{KeyECDSAP256, KeyRSA2048} {
+		_, otherKey, err := GenCA("other CA", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseCA(certPEM, otherKey); err == nil {
+			t.Errorf("%s: key of another CA accepted", keyType)
+		}
+	}
+}
+
+func TestWriteCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Certificate{
+		Pem:       filepath.Join(dir, "ca", "ca.pem"),
+		Key:       filepath.Join(dir, "ca", "ca.key"),
+		CAKeyType: KeyECDSAP256,
+	}
+	ca, err := LoadCA(c, "test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.Leaf.Subject.CommonName != "test CA" {
+		t.Errorf("subject %s", ca.Leaf.Subject)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Dir(c.Pem))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{}
+	for _, f := range files {
+		modes[f.Name()] = f.Mode().Perm()
+	}
+	if len(modes) != 2 || modes["ca.key"] != 0400 || modes["ca.pem"] != 0444 {
+		t.Errorf("files %v", modes)
+	}
+
+	if err = WriteCA(c, "test CA"); err == nil {
+		t.Error("existing CA overwritten")
+	}
+	again, err := LoadCA(c, "test CA")
+	if err != nil || !again.Leaf.Equal(ca.Leaf) {
+		t.Errorf("CA changed: %v", err)
+	}
+}
+
+func TestRotateCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := Certificate{
+		Pem:       filepath.Join(dir, "ca.pem"),
+		Key:       filepath.Join(dir, "ca.key"),
+		CAKeyType: KeyECDSAP256,
+	}
+	ca, err := LoadCA(c, "test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := c
+	bad.CAKeyType = "unknown"
+	if _, err = RotateCA(bad, "test CA"); err == nil {
+		t.Fatal("CA with unknown key type written")
+	}
+	again, err := LoadCA(c, "test CA")
+	if err != nil || !again.Leaf.Equal(ca.Leaf) {
+		t.Fatalf("old CA not restored: %v", err)
+	}
+
+	if _, err = RotateCA(c, "test CA"); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := LoadCA(c, "test CA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Leaf.SerialNumber.Cmp(ca.Leaf.SerialNumber) == 0 {
+		t.Errorf("rotated CA has the old serial %s", ca.Leaf.SerialNumber)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCertCacheSize = 1024
+	// certRenewBefore is how long before expiry a cached leaf is replaced.
+	certRenewBefore = time.Hour
+)
+
+type CertCacheStats struct {
+	Size    int     `json:"size"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// A certCache keeps the last used leaf certificates by name. Concurrent
+// misses for the same name share a single generation.
+type certCache struct {
+	gen  func(name string) (*tls.Certificate, error)
+	size int
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[string]*list.Element
+	group singleflight.Group
+
+	hits   int64
+	misses int64
+}
+
+type certEntry struct {
+	name string
+	cert *tls.Certificate
+}
+
+func newCertCache(size int, gen func(name string) (*tls.Certificate, error)) *certCache {
+	if size <= 0 {
+		size = defaultCertCacheSize
+	}
+
+	return &certCache{
+		gen:   gen,
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *certCache) Get(name string) (*tls.Certificate, error) {
+	return c.GetFunc(name, func() (*tls.Certificate, error) {
+		return c.gen(name)
+	})
+}
+
+// GetFunc is Get with gen used instead of the cache generator on a miss.
+func (c *certCache) GetFunc(name string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if cert := c.lookup(name); cert != nil {
+		atomic.AddInt64(&c.hits, 1)
+		return cert, nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	v, err, _ := c.group.Do(name, func() (interface{}, error) {
+		if cert := c.lookup(name); cert != nil {
+			return cert, nil
+		}
+
+		cert, err := gen()
+		if err != nil {
+			return nil, err
+		}
+		c.add(name, cert)
+
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*tls.Certificate), nil
+}
+
+func (c *certCache) lookup(name string) *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[name]
+	if !ok {
+		return nil
+	}
+
+	entry := el.Value.(*certEntry)
+	if time.Now().Add(certRenewBefore).After(entry.cert.Leaf.NotAfter) {
+		c.ll.Remove(el)
+		delete(c.items, name)
+		return nil
+	}
+	c.ll.MoveToFront(el)
+
+	return entry.cert
+}
+
+func (c *certCache) add(name string, cert *tls.Certificate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[name]; ok {
+		el.Value.(*certEntry).cert = cert
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[name] = c.ll.PushFront(&certEntry{name: name, cert: cert})
+	for c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*certEntry).name)
+	}
+}
+
+func (c *certCache) Stats() CertCacheStats {
+	c.mu.Lock()
+	size := c.ll.Len()
+	c.mu.Unlock()
+
+	stats := CertCacheStats{
+		Size:   size,
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+	if total := stats.Hits + stats.Misses; total != 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+
+	return stats
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCertCache(t *testing.T) {
+	var generated int64
+	notAfter := time.Now().Add(leafMaxAge)
+	cache := newCertCache(2, func(name string) (*tls.Certificate, error) {
+		atomic.AddInt64(&generated, 1)
+		time.Sleep(10 * time.Millisecond)
+		return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: notAfter}}, nil
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.Get("a.com"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if generated != 1 {
+		t.Fatalf("concurrent misses generated %d certs", generated)
+	}
+
+	for _, name := range []string{"b.com", "a.com", "c.com", "a.com"} {
+		if _, err := cache.Get(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if generated != 3 {
+		t.Errorf("expected a.com to stay cached, generated %d certs", generated)
+	}
+	if _, err := cache.Get("b.com"); err != nil || generated != 4 {
+		t.Errorf("expected b.com to be evicted, generated %d certs", generated)
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 2 || stats.Hits+stats.Misses != 15 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	notAfter = time.Now().Add(certRenewBefore / 2)
+	cache.add("d.com", &tls.Certificate{Leaf: &x509.Certificate{NotAfter: notAfter}})
+	if _, err := cache.Get("d.com"); err != nil || generated != 5 {
+		t.Errorf("expected expiring d.com to be regenerated, generated %d certs", generated)
+	}
+}
@@ -1,18 +1,24 @@
 package proxy
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
 )
 
 const (
@@ -25,11 +31,125 @@ const (
 		x509.KeyUsageKeyAgreement |
 		x509.KeyUsageCertSign |
 		x509.KeyUsageCRLSign
-	leafUsage = caUsage
+	leafUsage = x509.KeyUsageDigitalSignature
 )
 
-func genCert(ca *tls.Certificate, names []string) (*tls.Certificate, error) {
+// Key types of generated CA and leaf certificates.
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA3072   = "rsa3072"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyECDSAP521 = "ecdsa-p521"
+	KeyEd25519   = "ed25519"
+
+	DefaultKeyType = KeyECDSAP521
+)
+
+func validKeyType(keyType string) bool {
+	switch keyType {
+	case KeyRSA2048, KeyRSA3072, KeyRSA4096, KeyECDSAP256, KeyECDSAP384, KeyECDSAP521, KeyEd25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// certKey returns the name a leaf for name is generated and cached under.
+// With wildcard, names in a registrable domain share a "*.parent" leaf.
+func certKey(name string, wildcard bool) string {
+	name = strings.ToLower(name)
+	if !wildcard || net.ParseIP(name) != nil {
+		return name
+	}
+
+	i := strings.IndexByte(name, '.')
+	if i <= 0 || strings.HasPrefix(name, "*.") {
+		return name
+	}
+	parent := name[i+1:]
+	if _, err := publicsuffix.EffectiveTLDPlusOne(parent); err != nil {
+		return name
+	}
+
+	return "*." + parent
+}
+
+// certNames expands a cert key to the names of the leaf.
+func certNames(key string) []string {
+	if strings.HasPrefix(key, "*.") {
+		return []string{key, key[2:]}
+	}
+
+	return []string{key}
+}
+
+func genCert(ca *tls.Certificate, names []string, keyType string) (*tls.Certificate, error) {
 	now := time.Now().Add(-1 * time.Hour).UTC()
+	tmpl := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: names[0]},
+		NotBefore: now,
+		NotAfter:  now.Add(leafMaxAge),
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+
+	return signLeaf(ca, tmpl, keyType)
+}
+
+// genMirrorCert forges a leaf with the subject, alternative names and
+// validity of the upstream certificate. Validity is kept within the CA's.
+// A certificate with no alternative names gets the names of key, as clients
+// ignore the common name, and a wildcard key is added to the names.
+func genMirrorCert(ca *tls.Certificate, upstream *x509.Certificate, key, keyType string) (*tls.Certificate, error) {
+	tmpl := &x509.Certificate{
+		Subject:     upstream.Subject,
+		NotBefore:   upstream.NotBefore,
+		NotAfter:    upstream.NotAfter,
+		DNSNames:    append([]string(nil), upstream.DNSNames...),
+		IPAddresses: upstream.IPAddresses,
+		URIs:        upstream.URIs,
+	}
+	tmpl.Subject.ExtraNames = nil
+	if tmpl.NotBefore.Before(ca.Leaf.NotBefore) {
+		tmpl.NotBefore = ca.Leaf.NotBefore
+	}
+	if tmpl.NotAfter.After(ca.Leaf.NotAfter) {
+		tmpl.NotAfter = ca.Leaf.NotAfter
+	}
+	noNames := len(tmpl.DNSNames) == 0 && len(tmpl.IPAddresses) == 0 && len(tmpl.URIs) == 0
+	if noNames || strings.HasPrefix(key, "*.") {
+		for _, name := range certNames(key) {
+			if ip := net.ParseIP(name); ip != nil {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			} else if !hasName(tmpl.DNSNames, name) {
+				tmpl.DNSNames = append(tmpl.DNSNames, name)
+			}
+		}
+	}
+
+	return signLeaf(ca, tmpl, keyType)
+}
+
+func hasName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// signLeaf fills serial, usages and key of the leaf template and signs it
+// with the CA.
+func signLeaf(ca *tls.Certificate, tmpl *x509.Certificate, keyType string) (*tls.Certificate, error) {
 	if !ca.Leaf.IsCA {
 		return nil, errors.New("CA cert is not a CA")
 	}
@@ -38,20 +158,19 @@ func genCert(ca *tls.Certificate, names []string) (*tls.Certificate, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate serial number: %s", err)
 	}
-	tmpl := &x509.Certificate{
-		SerialNumber:          serialNumber,
-		Subject:               pkix.Name{CommonName: names[0]},
-		NotBefore:             now,
-		NotAfter:              now.Add(leafMaxAge),
-		KeyUsage:              leafUsage,
-		BasicConstraintsValid: true,
-		DNSNames:              names,
-		SignatureAlgorithm:    x509.ECDSAWithSHA512,
-	}
-	key, err := genKeyPair()
+	tmpl.SerialNumber = serialNumber
+	tmpl.KeyUsage = leafUsage
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	tmpl.BasicConstraintsValid = true
+	tmpl.SignatureAlgorithm = signatureAlgorithm(ca.Leaf.PublicKey)
+
+	key, err := genKeyPair(keyType)
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
 	x, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Leaf, key.Public(), ca.PrivateKey)
 	if err != nil {
 		return nil, err
@@ -63,14 +182,77 @@ func genCert(ca *tls.Certificate, names []string) (*tls.Certificate, error) {
 	return cert, nil
 }
 
-func genKeyPair() (*ecdsa.PrivateKey, error) {
-	return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+func genKeyPair(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyECDSAP521, "":
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, errors.Errorf("unknown key type %q", keyType)
+	}
 }
 
-func GenCA(name string) (certPEM, keyPEM []byte, err error) {
+// signatureAlgorithm picks the algorithm for certificates signed by the
+// owner of pub.
+func signatureAlgorithm(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			return x509.ECDSAWithSHA256
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384
+		default:
+			return x509.ECDSAWithSHA512
+		}
+	case ed25519.PublicKey:
+		return x509.PureEd25519
+	default:
+		return x509.UnknownSignatureAlgorithm
+	}
+}
+
+func marshalPrivateKey(key crypto.Signer) (*pem.Block, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "ECDSA PRIVATE KEY", Bytes: der}, nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+}
+
+func GenCA(name, keyType string) (certPEM, keyPEM []byte, err error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate serial number")
+	}
 	now := time.Now().UTC()
 	tmpl := &x509.Certificate{
-		SerialNumber:          big.NewInt(1),
+		SerialNumber:          serialNumber,
 		Subject:               pkix.Name{CommonName: name},
 		NotBefore:             now,
 		NotAfter:              now.Add(caMaxAge),
@@ -78,20 +260,20 @@ func GenCA(name string) (certPEM, keyPEM []byte, err error) {
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 		MaxPathLen:            2,
-		SignatureAlgorithm:    x509.ECDSAWithSHA512,
 	}
 
-	key, err := genKeyPair()
+	key, err := genKeyPair(keyType)
 	if err != nil {
 		return
 	}
+	tmpl.SignatureAlgorithm = signatureAlgorithm(key.Public())
 
 	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
 	if err != nil {
 		return
 	}
 
-	keyDER, err := x509.MarshalECPrivateKey(key)
+	keyBlock, err := marshalPrivateKey(key)
 	if err != nil {
 		return
 	}
@@ -101,10 +283,7 @@ func GenCA(name string) (certPEM, keyPEM []byte, err error) {
 		Bytes: certDER,
 	})
 
-	keyPEM = pem.EncodeToMemory(&pem.Block{
-		Type:  "ECDSA PRIVATE KEY",
-		Bytes: keyDER,
-	})
+	keyPEM = pem.EncodeToMemory(keyBlock)
 
 	return certPEM, keyPEM, nil
 }
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestGenCertKeyTypes(t *testing.T) {
+	for _, keyType := range []string{KeyRSA2048, KeyECDSAP256, KeyECDSAP384, KeyECDSAP521, KeyEd25519} {
+		certPEM, keyPEM, err := GenCA("test CA", keyType)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		ca, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+
+		leaf, err := genCert(&ca, []string{"example.com"}, keyType)
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if err := leaf.Leaf.CheckSignatureFrom(ca.Leaf); err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+	}
+}
+
+func TestCertKey(t *testing.T) {
+	cases := []struct {
+		name     string
+		wildcard bool
+		key      string
+	}{
+		{"a.example.com", false, "a.example.com"},
+		{"A.Example.com", true, "*.example.com"},
+		{"example.com", true, "example.com"},
+		{"a.co.uk", true, "a.co.uk"},
+		{"b.a.co.uk", true, "*.a.co.uk"},
+		{"10.0.0.1", true, "10.0.0.1"},
+		{"localhost", true, "localhost"},
+	}
+	for _, c := range cases {
+		if key := certKey(c.name, c.wildcard); key != c.key {
+			t.Errorf("certKey(%q, %v) = %q, want %q", c.name, c.wildcard, key, c.key)
+		}
+	}
+}
+
+func TestGenCertSANs(t *testing.T) {
+	certPEM, keyPEM, err := GenCA("test CA", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+
+	leaf, err := genCert(&ca, []string{"10.0.0.1"}, KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.Leaf.VerifyHostname("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err = genCert(&ca, certNames(certKey("a.example.com", true)), KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"a.example.com", "b.example.com", "example.com"} {
+		if err := leaf.Leaf.VerifyHostname(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	_, err = leaf.Leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenMirrorCert(t *testing.T) {
+	certPEM, keyPEM, err := GenCA("test CA", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+
+	spiffe, _ := url.Parse("spiffe://example.com/web")
+	upstream := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com", Organization: []string{"Example"}},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(90 * 24 * time.Hour),
+		DNSNames:    []string{"example.com", "www.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:        []*url.URL{spiffe},
+	}
+	leaf, err := genMirrorCert(&ca, upstream, "www.example.com", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Leaf.Subject.String() != upstream.Subject.String() {
+		t.Errorf("subject %q, want %q", leaf.Leaf.Subject, upstream.Subject)
+	}
+	if len(leaf.Leaf.DNSNames) != 2 || len(leaf.Leaf.IPAddresses) != 1 || len(leaf.Leaf.URIs) != 1 {
+		t.Errorf("SANs not copied: %v %v %v", leaf.Leaf.DNSNames, leaf.Leaf.IPAddresses, leaf.Leaf.URIs)
+	}
+	if !leaf.Leaf.NotAfter.Equal(upstream.NotAfter.Truncate(time.Second)) {
+		t.Errorf("not after %v, want %v", leaf.Leaf.NotAfter, upstream.NotAfter)
+	}
+
+	leaf, err = genMirrorCert(&ca, &x509.Certificate{Subject: pkix.Name{CommonName: "old"}}, "10.0.0.2", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.Leaf.VerifyHostname("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err = genMirrorCert(&ca, upstream, certKey("www.example.com", true), KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"www.example.com", "api.example.com", "example.com"} {
+		if err := leaf.Leaf.VerifyHostname(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(upstream.DNSNames) != 2 {
+		t.Errorf("upstream names changed: %v", upstream.DNSNames)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/Smet1/golang-proxy/internal/pkg/proxy"
 )
 
 const (
@@ -11,6 +13,11 @@ const (
 	HTTPS = "https"
 )
 
+const (
+	StoreMongo = "mongo"
+	StoreBolt  = "bolt"
+)
+
 type Duration struct {
 	time.Duration
 }
@@ -27,25 +34,52 @@ func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 type Config struct {
-	Protocol       string      `yaml:"protocol"`
-	Certificate    Certificate `yaml:"certificate"`
-	Timeout        Duration    `yaml:"timeout"`
-	ServeAddrProxy string      `yaml:"serve_addr_proxy"`
-	ServeAddrBurst string      `yaml:"serve_addr_burst"`
-	DB             DB          `yaml:"db"`
+	Protocol       string                  `yaml:"protocol"`
+	Certificate    Certificate             `yaml:"certificate"`
+	Timeout        Duration                `yaml:"timeout"`
+	ServeAddrProxy string                  `yaml:"serve_addr_proxy"`
+	ServeAddrBurst string                  `yaml:"serve_addr_burst"`
+	DB             DB                      `yaml:"db"`
+	Intercept      Intercept               `yaml:"intercept"`
+	Rules          []proxy.Rule            `yaml:"rules"`
+	Scope          proxy.ScopeSettings     `yaml:"scope"`
+	Passthrough    Passthrough             `yaml:"passthrough"`
+	CertCacheSize  int                     `yaml:"cert_cache_size"`
+	LandingHost    string                  `yaml:"landing_host"`
+	UpstreamTLS    []proxy.UpstreamTLSRule `yaml:"upstream_tls"`
 }
 
 type DB struct {
+	Type           string   `yaml:"type"`
 	Host           string   `yaml:"host"`
 	Port           string   `yaml:"port"`
 	Timeout        Duration `yaml:"timeout"`
 	DatabaseName   string   `yaml:"database_name"`
 	CollectionName string   `yaml:"collection_name"`
+	Path           string   `yaml:"path"`
+}
+
+type Intercept struct {
+	Enabled         bool                  `yaml:"enabled"`
+	Timeout         Duration              `yaml:"timeout"`
+	Rules           []proxy.InterceptRule `yaml:"rules"`
+	ResponseEnabled bool                  `yaml:"response_enabled"`
+	ResponseRules   []proxy.InterceptRule `yaml:"response_rules"`
+}
+
+// Passthrough hosts are tunneled without decryption. Auto adds hosts whose
+// clients refuse the generated certificate.
+type Passthrough struct {
+	Hosts []string `yaml:"hosts"`
+	Auto  bool     `yaml:"auto"`
 }
 
 type Certificate struct {
-	Pem string `yaml:"pem"`
-	Key string `yaml:"key"`
+	Pem         string `yaml:"pem"`
+	Key         string `yaml:"key"`
+	CAKeyType   string `yaml:"ca_key_type"`
+	LeafKeyType string `yaml:"leaf_key_type"`
+	Wildcard    bool   `yaml:"wildcard"`
 }
 
 func (c *Config) Validate() error {
@@ -53,5 +87,41 @@ func (c *Config) Validate() error {
 		return errors.New("protocol must be either http or https")
 	}
 
+	if c.LandingHost == "" {
+		c.LandingHost = DefaultLandingHost
+	}
+
+	if c.Certificate.Pem == "" {
+		c.Certificate.Pem = "ca-cert.pem"
+	}
+	if c.Certificate.Key == "" {
+		c.Certificate.Key = "ca-key.pem"
+	}
+	if c.Certificate.CAKeyType == "" {
+		c.Certificate.CAKeyType = DefaultKeyType
+	}
+	if c.Certificate.LeafKeyType == "" {
+		c.Certificate.LeafKeyType = DefaultKeyType
+	}
+	if !validKeyType(c.Certificate.CAKeyType) {
+		return errors.Errorf("unknown ca key type %q", c.Certificate.CAKeyType)
+	}
+	if !validKeyType(c.Certificate.LeafKeyType) {
+		return errors.Errorf("unknown leaf key type %q", c.Certificate.LeafKeyType)
+	}
+
+	if c.DB.Type == "" {
+		c.DB.Type = StoreMongo
+	}
+	switch c.DB.Type {
+	case StoreMongo:
+	case StoreBolt:
+		if c.DB.Path == "" {
+			return errors.New("db path is required for bolt store")
+		}
+	default:
+		return errors.Errorf("unknown db type %q", c.DB.Type)
+	}
+
 	return nil
 }
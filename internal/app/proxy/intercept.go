@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/Smet1/golang-proxy/internal/pkg/proxy"
+)
+
+func (i *Intercept) Settings() proxy.InterceptSettings {
+	return proxy.InterceptSettings{
+		Enabled:         i.Enabled,
+		Timeout:         i.Timeout.Duration,
+		Rules:           i.Rules,
+		ResponseEnabled: i.ResponseEnabled,
+		ResponseRules:   i.ResponseRules,
+	}
+}
+
+// Intercept holds req when it matches the intercept rules and applies the
+// operator decision to req and rs. It returns false when the request is
+// dropped and the client has already got the answer.
+func (s *Service) Intercept(res http.ResponseWriter, req *http.Request, rs *proxy.RequestSave) bool {
+	if s.Interceptor == nil || !s.Interceptor.Match(rs) {
+		return true
+	}
+
+	log := s.Log.WithField("id", rs.ID.Hex())
+	log.Info("request intercepted")
+
+	d := s.Interceptor.Hold(rs, req.Context().Done())
+	if d.Action == proxy.ActionDrop {
+		log.Info("request dropped")
+		proxy.ErrResponse(res, http.StatusForbidden, "request dropped by proxy")
+
+		return false
+	}
+
+	if d.Override != nil {
+		err := proxy.ApplyOverride(req, rs, d.Override)
+		if err != nil {
+			log.WithError(err).Error("can't apply override, forwarding as is")
+		}
+	}
+
+	return true
+}
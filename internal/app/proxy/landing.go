@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Smet1/golang-proxy/internal/pkg/proxy"
+)
+
+// DefaultLandingHost is the host the proxy answers itself on plain http.
+const DefaultLandingHost = "proxy.local"
+
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>golang-proxy</title></head>
+<body>
+<h1>golang-proxy</h1>
+<p>CA certificate: <a href="/ca.pem">PEM</a>, <a href="/ca.der">DER</a></p>
+<p>SHA-256: <code>{{.Fingerprint}}</code></p>
+<p>Proxy auto-config: <a href="/proxy.pac">proxy.pac</a> (proxy {{.Addr}})</p>
+</body>
+</html>
+`))
+
+// isLanding reports whether a plain http request is meant for the proxy
+// itself: sent to the landing host or to the address the proxy listens on.
+// Other requests, even with a relative url, are proxied to their Host.
+func (s *Service) isLanding(req *http.Request) bool {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+		if req.TLS != nil {
+			port = "443"
+		}
+	}
+	if strings.EqualFold(host, s.Config.LandingHost) {
+		return true
+	}
+
+	addrs := []string{s.proxyAddr(req)}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		addrs = append(addrs, local.String())
+	}
+	for _, addr := range addrs {
+		addrHost, addrPort, err := net.SplitHostPort(addr)
+		if err == nil && addrPort == port && sameHost(host, addrHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameHost compares host names and IPs, localhost being a loopback IP.
+func sameHost(host, addrHost string) bool {
+	if strings.EqualFold(host, addrHost) {
+		return true
+	}
+
+	ip := net.ParseIP(addrHost)
+	if ip == nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return ip.IsLoopback()
+	}
+
+	return ip.Equal(net.ParseIP(host))
+}
+
+// landing serves the CA certificate and the PAC file to onboard clients.
+func (s *Service) landing(res http.ResponseWriter, req *http.Request) {
+	log := s.Log.WithField("path", req.URL.Path)
+
+	switch req.URL.Path {
+	case "/":
+		fingerprint, _ := Fingerprint(s.CA.Leaf)
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := landingPage.Execute(res, map[string]string{
+			"Fingerprint": fingerprint,
+			"Addr":        s.proxyAddr(req),
+		})
+		if err != nil {
+			log.WithError(err).Error("can't render landing page")
+		}
+	case "/ca.pem", "/ca.crt":
+		s.serveCA(res, CAFormatPEM, "application/x-pem-file", "ca-cert.pem")
+	case "/ca.der", "/ca.cer":
+		s.serveCA(res, CAFormatDER, "application/x-x509-ca-cert", "ca-cert.der")
+	case "/proxy.pac":
+		pac, err := proxy.PAC(s.Scope.Settings(), s.proxyAddr(req), s.Config.Protocol == HTTPS, s.Config.LandingHost)
+		if err != nil {
+			proxy.ErrResponse(res, http.StatusInternalServerError, "can't generate pac")
+
+			log.WithError(err).Error("can't generate pac")
+			return
+		}
+		res.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = res.Write(pac)
+	default:
+		proxy.ErrResponse(res, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *Service) serveCA(res http.ResponseWriter, format, contentType, filename string) {
+	data, err := ExportCA(s.CA, format, "")
+	if err != nil {
+		proxy.ErrResponse(res, http.StatusInternalServerError, "can't export CA")
+
+		s.Log.WithError(err).Error("can't export CA")
+		return
+	}
+	res.Header().Set("Content-Type", contentType)
+	res.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	_, _ = res.Write(data)
+}
+
+// proxyAddr is the address clients reach the proxy on: ServeAddrProxy with
+// the host taken from the connection when the listener has none.
+func (s *Service) proxyAddr(req *http.Request) string {
+	host, port, err := net.SplitHostPort(s.Config.ServeAddrProxy)
+	if err != nil {
+		return s.Config.ServeAddrProxy
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			if local, _, err := net.SplitHostPort(addr.String()); err == nil {
+				host = local
+			}
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// ListenAndServe serves the proxy on ServeAddrProxy, over TLS when the
+// protocol is https, so clients can reach it safely on shared networks.
+func (s *Service) ListenAndServe() error {
+	ln, err := net.Listen("tcp", s.Config.ServeAddrProxy)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(ln)
+}
+
+// Serve serves the proxy on ln like ListenAndServe.
+func (s *Service) Serve(ln net.Listener) error {
+	srv := &http.Server{Handler: s}
+	if s.Config.Protocol != HTTPS {
+		return srv.Serve(ln)
+	}
+
+	srv.TLSConfig = &tls.Config{}
+	if s.TLSServerConfig != nil {
+		srv.TLSConfig = s.TLSServerConfig.Clone()
+	}
+	// CONNECT hijacks the connection, which h2 can't do.
+	srv.TLSConfig.NextProtos = []string{"http/1.1"}
+	srv.TLSConfig.GetCertificate = s.listenerCert
+
+	return srv.ServeTLS(ln, "", "")
+}
+
+// listenerCert issues the listener certificate with the CA for the name
+// the client asked for, or the address it connected to without SNI.
+func (s *Service) listenerCert(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := hello.ServerName
+	if name == "" {
+		host, _, err := net.SplitHostPort(hello.Conn.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		name = host
+	}
+
+	return s.cert(name)
+}
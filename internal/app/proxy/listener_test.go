@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestServeTLS(t *testing.T) {
+	handler := http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte(req.Host))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p := newTestProxy(t)
+	defer p.Close()
+	p.Config.Protocol = HTTPS
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		_ = p.Serve(ln)
+	}()
+
+	// The proxy certificate and the MITM ones are issued by the CA.
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(&url.URL{Scheme: "https", Host: ln.Addr().String()}),
+			TLSClientConfig: &tls.Config{RootCAs: p.roots},
+		},
+	}
+	for _, upstream := range []string{secure.URL, plain.URL} {
+		resp, err := client.Get(upstream + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if u, _ := url.Parse(upstream); string(body) != u.Host {
+			t.Errorf("%s: got %q", upstream, body)
+		}
+	}
+
+	list := p.records(t, 2)
+	if list[0].URL.Scheme != "https" || list[1].URL.Scheme != "http" {
+		t.Errorf("recorded %s and %s", list[0].TargetURL(), list[1].TargetURL())
+	}
+}
@@ -1,12 +1,17 @@
 package proxy
 
 import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -14,6 +19,7 @@ import (
 	"github.com/gorilla/mux"
 
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 
 	"github.com/sirupsen/logrus"
 
@@ -38,12 +44,58 @@ type Service struct {
 	TLSServerConfig *tls.Config
 
 	// TLSClientConfig specifies the tls.Config to use when establishing
-	// an upstream connection for proxying.
+	// an upstream connection for proxying. It is the base of UpstreamTLS.
 	TLSClientConfig *tls.Config
-	Collection      *mgo.Collection
+
+	// Store keeps requests passed through the proxy.
+	Store proxy.Store
+
+	// Interceptor holds requests for manual edit before forwarding.
+	Interceptor *proxy.Interceptor
+
+	// Rules rewrite proxied requests and responses.
+	Rules *proxy.RuleSet
+
+	// Scope selects flows which are recorded and intercepted. CONNECTs to
+	// hosts out of scope are tunneled without decryption.
+	Scope *proxy.Scope
+
+	// UpstreamTLS selects TLS settings of connections to upstreams.
+	UpstreamTLS *proxy.UpstreamTLS
+
+	// Passthrough lists hosts tunneled without decryption.
+	Passthrough *proxy.Passthrough
+
+	// WebSockets keeps the open WebSockets for frame injection.
+	WebSockets *proxy.WebSockets
+
+	certs     *certCache
+	certsOnce sync.Once
+
+	upstreams    map[string]*list.Element
+	upstreamsLRU *list.List
+	upstreamsMu  sync.Mutex
 }
 
-func (s *Service) EnsureDBConn(config *DB) error {
+// EnsureStore opens the request store selected by config.Type.
+func (s *Service) EnsureStore(config *DB) error {
+	switch config.Type {
+	case StoreMongo:
+		return s.ensureMongo(config)
+	case StoreBolt:
+		store, err := proxy.NewBoltStore(config.Path, config.Timeout.Duration)
+		if err != nil {
+			return errors.Wrap(err, "can't open bolt store")
+		}
+		s.Store = store
+
+		return nil
+	default:
+		return errors.Errorf("unknown db type %q", config.Type)
+	}
+}
+
+func (s *Service) ensureMongo(config *DB) error {
 	session, err := mgo.DialWithInfo(&mgo.DialInfo{
 		Addrs:    []string{fmt.Sprintf("%s:%s", config.Host, config.Port)},
 		Timeout:  config.Timeout.Duration,
@@ -53,30 +105,80 @@ func (s *Service) EnsureDBConn(config *DB) error {
 		return errors.Wrap(err, "can't dial mongo")
 	}
 
-	s.Collection = session.DB(config.DatabaseName).C(config.CollectionName)
+	s.Store = proxy.NewMongoStore(session.DB(config.DatabaseName).C(config.CollectionName))
 
 	return nil
 }
 
 func (s *Service) GetServerBurst(logger *logrus.Logger) *http.Server {
-	handlerBurst := proxy.GetBurstHandler(s.Client, s.Collection)
+	handlerBurst := proxy.GetBurstHandler(s.Client, s.Store)
 
 	s.Router = mux.NewRouter()
 	s.Router.HandleFunc("/burst", handlerBurst).Methods(http.MethodPost)
+	s.Router.HandleFunc("/requests", proxy.GetListHandler(s.Store)).Methods(http.MethodGet)
+	s.Router.HandleFunc("/requests/import/curl", proxy.GetCurlImportHandler(s.Store)).Methods(http.MethodPost)
+	s.Router.HandleFunc("/requests/{id}", proxy.GetRequestHandler(s.Store)).Methods(http.MethodGet)
+	s.Router.HandleFunc("/requests/{id}/frames", proxy.GetFramesHandler(s.Store)).Methods(http.MethodGet)
+	s.Router.HandleFunc("/requests/{id}/replay", proxy.GetReplayHandler(s.Client, s.Store, s.WebSockets)).Methods(http.MethodPost)
+	s.Router.HandleFunc("/requests/{id}/curl", proxy.GetCurlHandler(s.Store)).Methods(http.MethodGet)
+	s.Router.HandleFunc("/har", proxy.GetHARHandler(s.Store)).Methods(http.MethodGet)
+	s.Router.HandleFunc("/har", proxy.GetHARImportHandler(s.Store)).Methods(http.MethodPost)
+	s.Router.HandleFunc("/stats/certs", s.certStatsHandler).Methods(http.MethodGet)
+	if s.Scope != nil {
+		s.Router.HandleFunc("/scope", proxy.GetScopeHandler(s.Scope)).Methods(http.MethodGet)
+		s.Router.HandleFunc("/scope", proxy.GetSetScopeHandler(s.Scope)).Methods(http.MethodPut)
+	}
+	if s.Rules != nil {
+		s.Router.HandleFunc("/rules", proxy.GetRulesHandler(s.Rules)).Methods(http.MethodGet)
+		s.Router.HandleFunc("/rules", proxy.GetSetRulesHandler(s.Rules)).Methods(http.MethodPut)
+		s.Router.HandleFunc("/rules/{name}", proxy.GetToggleRuleHandler(s.Rules)).Methods(http.MethodPut)
+	}
+	if s.WebSockets != nil {
+		s.Router.HandleFunc("/websockets", proxy.GetWebSocketsHandler(s.WebSockets)).Methods(http.MethodGet)
+		s.Router.HandleFunc("/websockets/{id}", proxy.GetInjectHandler(s.WebSockets)).Methods(http.MethodPost)
+	}
+	if s.Interceptor != nil {
+		s.Router.HandleFunc("/intercept", proxy.GetInterceptHandler(s.Interceptor)).Methods(http.MethodGet)
+		s.Router.HandleFunc("/intercept", proxy.GetInterceptSettingsHandler(s.Interceptor)).Methods(http.MethodPut)
+		s.Router.HandleFunc("/intercept/{id}", proxy.GetInterceptDecisionHandler(s.Interceptor)).Methods(http.MethodPost)
+	}
 	return &http.Server{
 		Addr:    s.Config.ServeAddrBurst,
 		Handler: s.Router,
 	}
 }
 
-func (s *Service) cert(names ...string) (*tls.Certificate, error) {
-	return genCert(s.CA, names)
+func (s *Service) certCache() *certCache {
+	s.certsOnce.Do(func() {
+		s.certs = newCertCache(s.Config.CertCacheSize, func(key string) (*tls.Certificate, error) {
+			return genCert(s.CA, certNames(key), s.Config.Certificate.LeafKeyType)
+		})
+	})
+
+	return s.certs
+}
+
+func (s *Service) cert(name string) (*tls.Certificate, error) {
+	return s.certCache().Get(certKey(name, s.Config.Certificate.Wildcard))
+}
+
+// mirrorCert returns a leaf for name copying the upstream certificate.
+// With wildcard, the subdomains behind the same certificate share it.
+func (s *Service) mirrorCert(upstream *x509.Certificate, name string) (*tls.Certificate, error) {
+	sum := sha256.Sum256(upstream.Raw)
+	key := certKey(name, s.Config.Certificate.Wildcard)
+
+	return s.certCache().GetFunc(key+"@"+hex.EncodeToString(sum[:]), func() (*tls.Certificate, error) {
+		return genMirrorCert(s.CA, upstream, key, s.Config.Certificate.LeafKeyType)
+	})
+}
+
+func (s *Service) certStatsHandler(res http.ResponseWriter, req *http.Request) {
+	proxy.OkResponse(res, s.certCache().Stats())
 }
 
 func (s *Service) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	if req.Method == http.MethodConnect {
-		var sconn *tls.Conn
-
 		host, _, err := net.SplitHostPort(req.Host)
 		if err != nil {
 			s.Log.WithError(err).Error("cannot determine cert name")
@@ -85,72 +187,152 @@ func (s *Service) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		provisionalCert, err := s.cert(host)
-		if err != nil {
-			s.Log.WithError(err).Error("cert")
-			proxy.ErrResponse(res, http.StatusForbidden, "no upstream")
+		if s.passthrough(req.Host) {
+			s.tunnel(res, req)
 
 			return
 		}
 
+		// No static certificates, so GetCertificate runs for clients
+		// without SNI too and the leaf can mirror the upstream one.
 		sConfig := &tls.Config{}
 		if s.TLSServerConfig != nil {
-			sConfig = s.TLSServerConfig
+			sConfig = s.TLSServerConfig.Clone()
 		}
-		sConfig.Certificates = []tls.Certificate{*provisionalCert}
+		sConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		upstreamFailed := false
+		var upstream *upstreamTransport
 		sConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			cConfig := &tls.Config{}
-			if s.TLSClientConfig != nil {
-				cConfig = s.TLSClientConfig
+			upstream = s.upstream(req.Host, hello.ServerName)
+			if upstream.Peer() == nil {
+				_, err := upstream.Dial()
+				if err != nil {
+					upstreamFailed = true
+					s.Log.WithError(err).WithField("host", req.Host).Error("got err on tls dial")
+
+					return nil, err
+				}
 			}
-			cConfig.ServerName = hello.ServerName
-			sconn, err = tls.Dial("tcp", req.Host, cConfig)
-			if err != nil {
-				log.Println("dial", req.Host, err)
-				s.Log.WithError(err).WithField("host", req.Host).Error("got err on tls dial")
 
-				return nil, err
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			if peer := upstream.Peer(); peer != nil {
+				return s.mirrorCert(peer, name)
 			}
-			return s.cert(hello.ServerName)
+			return s.cert(name)
 		}
 
 		cconn, err := handshake(res, sConfig, s.Log)
 		if err != nil {
 			s.Log.WithField("host", req.Host).WithError(err).Error("handshake err")
+			if !upstreamFailed {
+				s.Passthrough.HandshakeFailed(req.Host, err)
+			}
 
 			return
 		}
 		defer cconn.Close()
-		if sconn == nil {
-			s.Log.WithError(err).Error("cannot determine cert name")
+
+		tlsConn, ok := cconn.(*tls.Conn)
+		if !ok {
+			// Not TLS, as for ws:// through CONNECT, so plain http is
+			// proxied to the Host of each request.
+			serveConn(cconn, s.Wrap(s.reverseProxy(httpDirector, nil)))
 
 			return
 		}
-		defer sconn.Close()
 
-		od := &oneShotDialer{c: sconn}
-		rp := &httputil.ReverseProxy{
-			Director:      httpsDirector,
-			Transport:     &http.Transport{DialTLS: od.Dial},
-			FlushInterval: 0,
+		rp := s.reverseProxy(httpsDirector, upstream)
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			h2 := &http2.Server{}
+			h2.ServeConn(cconn, &http2.ServeConnOpts{Handler: s.Wrap(rp)})
+
+			return
 		}
+		serveConn(cconn, s.Wrap(rp))
+
+		return
+	}
 
-		ch := make(chan int)
-		wc := &onCloseConn{cconn, func() { ch <- 0 }}
-		_ = http.Serve(&oneShotListener{wc}, s.Wrap(rp))
-		<-ch
+	if s.isLanding(req) {
+		s.landing(res, req)
 
 		return
 	}
 
-	rp := &httputil.ReverseProxy{
-		Director: func(request *http.Request) {
-			req.URL.Host = req.Host
-			req.URL.Scheme = "http"
+	s.Wrap(s.reverseProxy(httpDirector, nil)).ServeHTTP(res, req)
+}
+
+// reverseProxy sends requests upstream through transport, or the default
+// one when it is nil, applying rules and interception.
+func (s *Service) reverseProxy(director func(*http.Request), transport http.RoundTripper) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director:       s.director(director),
+		Transport:      transport,
+		FlushInterval:  0,
+		ErrorHandler:   proxy.GetErrorHandler(s.Log),
+		ModifyResponse: s.modifyResponse,
+	}
+}
+
+// serveConn serves HTTP/1.1 on conn until it is closed, or hijacked and the
+// handler which took it over has returned. The conn is served as is, not
+// wrapped, so requests get its TLS state.
+func serveConn(conn net.Conn, handler http.Handler) {
+	var handlers sync.WaitGroup
+	done := make(chan struct{})
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			handlers.Add(1)
+			defer handlers.Done()
+			handler.ServeHTTP(res, req)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				close(done)
+			}
 		},
-		FlushInterval: 0,
 	}
-	s.Wrap(rp).ServeHTTP(res, req)
+	_ = srv.Serve(&oneShotListener{conn})
+	<-done
+	handlers.Wait()
+}
+
+// passthrough reports whether CONNECT to hostport must be tunneled without
+// decryption.
+func (s *Service) passthrough(hostport string) bool {
+	return s.Passthrough.Match(hostport) ||
+		s.Passthrough.Match(proxy.Hostname(hostport)) ||
+		!s.Scope.InScope(&url.URL{Scheme: "https", Host: hostport})
+}
+
+func (s *Service) tunnel(res http.ResponseWriter, req *http.Request) {
+	upstream, err := proxy.DialTunnel(req.Host)
+	if err != nil {
+		proxy.ErrResponse(res, http.StatusBadGateway, "can't dial upstream")
+
+		s.Log.WithError(err).WithField("host", req.Host).Error("can't dial upstream")
+		return
+	}
+
+	raw, rw, err := res.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		s.Log.WithError(err).Error("no upstream")
+		proxy.ErrResponse(res, http.StatusForbidden, "no upstream")
+
+		return
+	}
+	if _, err = raw.Write(okHeader); err != nil {
+		upstream.Close()
+		raw.Close()
+
+		return
+	}
+
+	proxy.Tunnel(raw, rw.Reader, upstream, req.Host, s.Log)
 }
 
 func httpsDirector(r *http.Request) {
@@ -158,21 +340,84 @@ func httpsDirector(r *http.Request) {
 	r.URL.Scheme = "https"
 }
 
+func httpDirector(r *http.Request) {
+	r.URL.Host = r.Host
+	r.URL.Scheme = "http"
+}
+
+// director applies the request rules after base.
+func (s *Service) director(base func(*http.Request)) func(*http.Request) {
+	return func(r *http.Request) {
+		base(r)
+		if err := s.Rules.ApplyRequest(r); err != nil {
+			s.Log.WithError(err).WithField("host", r.Host).Error("can't apply request rules")
+		}
+	}
+}
+
+// modifyResponse records the upstream protocol and TLS verification, applies
+// the response rules and then holds the response if
+// it has to be intercepted. Upgraded connections are only captured.
+func (s *Service) modifyResponse(resp *http.Response) error {
+	rs := proxy.RequestSaveFromContext(resp.Request.Context())
+	if rs != nil && resp.TLS != nil {
+		rs.UpstreamTLS = s.UpstreamTLS.Verify(resp.Request.URL.Host, resp.TLS)
+		rs.UpstreamProtocol = proxy.NegotiatedProtocol(resp.TLS, resp.ProtoMajor)
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if rs != nil {
+			proxy.CaptureWebSocket(resp, rs, s.Store, s.WebSockets, s.Log)
+		}
+		return nil
+	}
+	if err := s.Rules.ApplyResponse(resp); err != nil {
+		s.Log.WithError(err).WithField("host", resp.Request.Host).Error("can't apply response rules")
+	}
+
+	return proxy.GetModifyResponse(s.Interceptor, s.Log)(resp)
+}
+
 var okHeader = []byte("HTTP/1.1 200 OK\r\n\r\n")
 
+// tlsRecordHandshake is the first byte of a TLS ClientHello.
+const tlsRecordHandshake = 0x16
+
+// A bufferedConn reads what was buffered before the hijack first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// handshake answers CONNECT and does the TLS handshake with the client. A
+// client which doesn't start with a TLS record gets its plain conn back.
 func handshake(res http.ResponseWriter, config *tls.Config, logger *logrus.Logger) (net.Conn, error) {
-	raw, _, err := res.(http.Hijacker).Hijack()
+	hijacked, rw, err := res.(http.Hijacker).Hijack()
 	if err != nil {
 		logger.WithError(err).Error("no upstream")
 		proxy.ErrResponse(res, http.StatusForbidden, "no upstream")
 
 		return nil, err
 	}
-	if _, err = raw.Write(okHeader); err != nil {
+	if _, err = hijacked.Write(okHeader); err != nil {
+		hijacked.Close()
+
+		return nil, err
+	}
+
+	raw := &bufferedConn{Conn: hijacked, r: rw.Reader}
+	first, err := rw.Reader.Peek(1)
+	if err != nil {
 		raw.Close()
 
 		return nil, err
 	}
+	if first[0] != tlsRecordHandshake {
+		return raw, nil
+	}
 
 	conn := tls.Server(raw, config)
 	err = conn.Handshake()
@@ -186,24 +431,6 @@ func handshake(res http.ResponseWriter, config *tls.Config, logger *logrus.Logge
 	return conn, nil
 }
 
-// A oneShotDialer implements net.Dialer whos Dial only returns a
-// net.Conn as specified by c followed by an error for each subsequent Dial.
-type oneShotDialer struct {
-	c  net.Conn
-	mu sync.Mutex
-}
-
-func (d *oneShotDialer) Dial(network, addr string) (net.Conn, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.c == nil {
-		return nil, errors.New("closed")
-	}
-	c := d.c
-	d.c = nil
-	return c, nil
-}
-
 // A oneShotListener implements net.Listener whos Accept only returns a
 // net.Conn as specified by c followed by an error for each subsequent Accept.
 type oneShotListener struct {
@@ -226,17 +453,3 @@ func (l *oneShotListener) Close() error {
 func (l *oneShotListener) Addr() net.Addr {
 	return l.c.LocalAddr()
 }
-
-// A onCloseConn implements net.Conn and calls its f on Close.
-type onCloseConn struct {
-	net.Conn
-	f func()
-}
-
-func (c *onCloseConn) Close() error {
-	if c.f != nil {
-		c.f()
-		c.f = nil
-	}
-	return c.Conn.Close()
-}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Smet1/golang-proxy/internal/pkg/proxy"
+)
+
+// A testProxy runs a Service wired like cmd/proxy does, which records
+// flows in a bolt store and doesn't check upstream certificates.
+type testProxy struct {
+	*Service
+
+	srv   *httptest.Server
+	dir   string
+	roots *x509.CertPool
+}
+
+func newTestProxy(t *testing.T) *testProxy {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM, keyPEM, err := GenCA("test", KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ParseCA(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := Config{
+		Protocol:    HTTP,
+		Certificate: Certificate{LeafKeyType: KeyECDSAP256},
+		DB:          DB{Type: StoreBolt, Path: filepath.Join(dir, "history.db"), Timeout: Duration{time.Second}},
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	s := &Service{Config: config, CA: ca, Log: log}
+	if err = s.EnsureStore(&config.DB); err != nil {
+		t.Fatal(err)
+	}
+	s.UpstreamTLS, err = proxy.NewUpstreamTLS([]proxy.UpstreamTLSRule{{Host: "*", InsecureSkipVerify: true}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WebSockets = proxy.NewWebSockets()
+	s.Wrap = func(upstream http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			rs, err := proxy.NewRequestSave(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req = req.WithContext(proxy.WithRequestSave(req.Context(), rs))
+			rec := proxy.NewResponseRecorder(res)
+			upstream.ServeHTTP(rec, req)
+			rs.Response = rec.Response()
+			if _, err := s.Store.Save(rs); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	p := &testProxy{
+		Service: s,
+		dir:     dir,
+		roots:   x509.NewCertPool(),
+	}
+	p.roots.AddCert(ca.Leaf)
+	p.srv = httptest.NewServer(s)
+
+	return p
+}
+
+func (p *testProxy) Close() {
+	p.srv.Close()
+	p.Store.Close()
+	os.RemoveAll(p.dir)
+}
+
+// client sends requests through the proxy and trusts its CA.
+func (p *testProxy) client(h2 bool) *http.Client {
+	proxyURL, _ := url.Parse(p.srv.URL)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			TLSClientConfig:   &tls.Config{RootCAs: p.roots},
+			ForceAttemptHTTP2: h2,
+		},
+	}
+}
+
+// records waits for n flows to be saved, as they are after the response.
+func (p *testProxy) records(t *testing.T, n int) []*proxy.RequestSave {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		list, err := p.Store.List(proxy.ListOptions{Oldest: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) >= n {
+			return list
+		}
+	}
+	t.Fatalf("%d flows aren't saved", n)
+
+	return nil
+}
+
+func TestRulesOnHTTPS(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte("hello world, " + req.Header.Get("X-Rule")))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t)
+	defer p.Close()
+	var err error
+	p.Rules, err = proxy.NewRuleSet([]proxy.Rule{
+		{Name: "header", Enabled: true, Type: proxy.RuleRequestHeader, Replace: "X-Rule: on"},
+		{Name: "body", Enabled: true, Type: proxy.RuleResponseBody, Match: "world", Replace: "proxy"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.client(false).Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello proxy, on" {
+		t.Errorf("got %q", body)
+	}
+
+	rs := p.records(t, 1)[0]
+	if rs.URL.Scheme != "https" || len(rs.Rules) != 2 {
+		t.Errorf("scheme %s, rules %v", rs.URL.Scheme, rs.Rules)
+	}
+}
+
+func TestPassthroughTunnel(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte("tunneled"))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t)
+	defer p.Close()
+	var err error
+	p.Passthrough, err = proxy.NewPassthrough([]string{"127.0.0.1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := p.client(false)
+	client.Transport.(*http.Transport).TLSClientConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tunneled" {
+		t.Errorf("got %q", body)
+	}
+
+	upstream.Close()
+	client.CloseIdleConnections()
+	if _, err = client.Get(upstream.URL); err == nil || !strings.Contains(err.Error(), "Bad Gateway") {
+		t.Errorf("tunnel to a closed port: %v", err)
+	}
+
+	if list, err := p.Store.List(proxy.ListOptions{}); err != nil || len(list) != 0 {
+		t.Errorf("tunnels recorded: %v, %v", list, err)
+	}
+}
+
+func TestLanding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	p := newTestProxy(t)
+	defer p.Close()
+
+	get := func(client *http.Client, url, host string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		return string(body)
+	}
+	isPEM := func(body string) bool {
+		return strings.HasPrefix(body, "-----BEGIN CERTIFICATE-----")
+	}
+
+	// Straight to the listener, by its address or as localhost.
+	proxyURL, _ := url.Parse(p.srv.URL)
+	if body := get(http.DefaultClient, p.srv.URL+"/ca.pem", ""); !isPEM(body) {
+		t.Errorf("listener address: %q", body)
+	}
+	if body := get(http.DefaultClient, p.srv.URL+"/ca.pem", "localhost:"+proxyURL.Port()); !isPEM(body) {
+		t.Errorf("localhost: %q", body)
+	}
+	// Through the proxy to the landing host.
+	if body := get(p.client(false), "http://proxy.local/ca.pem", ""); !isPEM(body) {
+		t.Errorf("landing host: %q", body)
+	}
+	// A relative url for another host is proxied.
+	if body := get(http.DefaultClient, p.srv.URL+"/ca.pem", strings.TrimPrefix(upstream.URL, "http://")); body != "upstream" {
+		t.Errorf("other host: %q", body)
+	}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	upstreamDialTimeout = 30 * time.Second
+	upstreamIdleTimeout = 90 * time.Second
+	upstreamMaxIdle     = 16
+	// maxUpstreams bounds the transports kept for MITM tunnels, the least
+	// recently used ones and the ones idle for upstreamIdleTimeout are
+	// closed.
+	maxUpstreams = 256
+	// spareMaxAge is how long a connection dialed to forge the certificate
+	// waits for the first request of the tunnel.
+	spareMaxAge = 10 * time.Second
+)
+
+// An upstreamTransport pools TLS connections to one upstream address with
+// one server name, whatever the request url says, so MITM tunnels to the
+// same site share connections.
+type upstreamTransport struct {
+	addr   string
+	config *tls.Config
+
+	transport *http.Transport
+	// h1 sends upgrade requests, which can't go over h2.
+	h1 *http.Transport
+
+	mu        sync.Mutex
+	peer      *x509.Certificate
+	spare     *tls.Conn
+	spareTime time.Time
+}
+
+// newUpstreamTransport offers h2 and http/1.1 to the upstream and speaks
+// what it picks, or only http/1.1 if h2 can't be set up.
+func newUpstreamTransport(addr string, config *tls.Config, log *logrus.Logger) *upstreamTransport {
+	config.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	t := &upstreamTransport{
+		addr:   addr,
+		config: config,
+	}
+	t.transport = &http.Transport{
+		DialTLS:             t.dialTLS,
+		MaxIdleConnsPerHost: upstreamMaxIdle,
+		IdleConnTimeout:     upstreamIdleTimeout,
+	}
+	if err := http2.ConfigureTransport(t.transport); err != nil {
+		config.NextProtos = []string{"http/1.1"}
+		log.WithError(err).WithField("host", addr).Error("can't configure h2 upstream transport")
+	}
+	t.h1 = &http.Transport{
+		DialTLS:             t.dialH1,
+		MaxIdleConnsPerHost: upstreamMaxIdle,
+		IdleConnTimeout:     upstreamIdleTimeout,
+	}
+
+	return t
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Upgrade") != "" {
+		return t.h1.RoundTrip(req)
+	}
+
+	return t.transport.RoundTrip(req)
+}
+
+// Close closes the idle connections, requests in flight finish.
+func (t *upstreamTransport) Close() {
+	t.mu.Lock()
+	spare := t.spare
+	t.spare = nil
+	t.mu.Unlock()
+	if spare != nil {
+		spare.Close()
+	}
+
+	t.transport.CloseIdleConnections()
+	t.h1.CloseIdleConnections()
+}
+
+// Dial connects to the upstream and keeps the connection for the next
+// request sent through the transport.
+func (t *upstreamTransport) Dial() (*tls.Conn, error) {
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	old := t.spare
+	t.spare, t.spareTime = conn, time.Now()
+	t.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	return conn, nil
+}
+
+// Peer returns the upstream certificate seen last, if any.
+func (t *upstreamTransport) Peer() *x509.Certificate {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.peer
+}
+
+func (t *upstreamTransport) dial() (*tls.Conn, error) {
+	return t.dialConfig(t.config)
+}
+
+func (t *upstreamTransport) dialH1(network, addr string) (net.Conn, error) {
+	config := t.config.Clone()
+	config.NextProtos = []string{"http/1.1"}
+
+	return t.dialConfig(config)
+}
+
+func (t *upstreamTransport) dialConfig(config *tls.Config) (*tls.Conn, error) {
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", t.addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if peers := conn.ConnectionState().PeerCertificates; len(peers) != 0 {
+		t.mu.Lock()
+		t.peer = peers[0]
+		t.mu.Unlock()
+	}
+
+	return conn, nil
+}
+
+func (t *upstreamTransport) dialTLS(network, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	spare, spareTime := t.spare, t.spareTime
+	t.spare = nil
+	t.mu.Unlock()
+
+	if spare != nil {
+		if time.Since(spareTime) < spareMaxAge {
+			return spare, nil
+		}
+		spare.Close()
+	}
+
+	return t.dial()
+}
+
+type upstreamEntry struct {
+	key       string
+	transport *upstreamTransport
+	used      time.Time
+}
+
+// upstream returns the shared transport for the CONNECT address and the
+// server name the client asked for.
+func (s *Service) upstream(addr, serverName string) *upstreamTransport {
+	key := addr + "/" + serverName
+	now := time.Now()
+
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	if s.upstreams == nil {
+		s.upstreams = make(map[string]*list.Element)
+		s.upstreamsLRU = list.New()
+	}
+	if el, ok := s.upstreams[key]; ok {
+		entry := el.Value.(*upstreamEntry)
+		entry.used = now
+		s.upstreamsLRU.MoveToFront(el)
+		return entry.transport
+	}
+
+	t := newUpstreamTransport(addr, s.UpstreamTLS.Config(addr, serverName), s.Log)
+	s.upstreams[key] = s.upstreamsLRU.PushFront(&upstreamEntry{key: key, transport: t, used: now})
+	for el := s.upstreamsLRU.Back(); el != nil; el = s.upstreamsLRU.Back() {
+		entry := el.Value.(*upstreamEntry)
+		if s.upstreamsLRU.Len() <= maxUpstreams && now.Sub(entry.used) < upstreamIdleTimeout {
+			break
+		}
+		s.upstreamsLRU.Remove(el)
+		delete(s.upstreams, entry.key)
+		entry.transport.Close()
+	}
+
+	return t
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestUpstreamTransportReuse(t *testing.T) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	addr := srv.Listener.Addr().String()
+	up := newUpstreamTransport(addr, &tls.Config{InsecureSkipVerify: true}, logrus.New())
+	if _, err := up.Dial(); err != nil {
+		t.Fatal(err)
+	}
+	if up.Peer() == nil {
+		t.Fatal("no peer certificate")
+	}
+
+	client := &http.Client{Transport: up.transport}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get("https://example.com/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Fatalf("%d upstream connections, want 1", n)
+	}
+}
+
+func TestUpstreamEviction(t *testing.T) {
+	p := newTestProxy(t)
+	defer p.Close()
+
+	first := p.upstream("a.com:443", "a.com")
+	for i := 0; i < maxUpstreams; i++ {
+		if p.upstream("a.com:443", "a.com") != first {
+			t.Fatal("transport isn't shared")
+		}
+		p.upstream(fmt.Sprintf("host%d.com:443", i), "")
+	}
+	if len(p.upstreams) != maxUpstreams || p.upstreamsLRU.Len() != maxUpstreams {
+		t.Fatalf("%d transports kept", len(p.upstreams))
+	}
+	if _, ok := p.upstreams["host0.com:443/"]; ok {
+		t.Error("least recently used transport kept")
+	}
+	if _, ok := p.upstreams["a.com:443/a.com"]; !ok {
+		t.Error("recently used transport evicted")
+	}
+
+	// One is evicted for the new transport, the other one as idle.
+	for el, i := p.upstreamsLRU.Back(), 0; i < 2; el, i = el.Prev(), i+1 {
+		el.Value.(*upstreamEntry).used = time.Now().Add(-upstreamIdleTimeout)
+	}
+	p.upstream("b.com:443", "")
+	if len(p.upstreams) != maxUpstreams-1 {
+		t.Errorf("idle transport kept, %d transports", len(p.upstreams))
+	}
+}
+
+func TestMITMKeepAlive(t *testing.T) {
+	var conns int64
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte(req.URL.Path))
+	}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	p := newTestProxy(t)
+	defer p.Close()
+	var connects int64
+	client := p.client(false)
+	client.Transport.(*http.Transport).DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt64(&connects, 1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(upstream.URL + "/" + strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "/"+strconv.Itoa(i) {
+			t.Errorf("request %d: got %q", i, body)
+		}
+	}
+
+	if n := atomic.LoadInt64(&connects); n != 1 {
+		t.Errorf("%d connections to the proxy, want 1", n)
+	}
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("%d upstream connections, want 1", n)
+	}
+	if list := p.records(t, 5); len(list) != 5 || list[4].URL.Path != "/4" {
+		t.Errorf("records %v", list)
+	}
+}
+
+func TestMITMProtocols(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		_, _ = res.Write([]byte(req.Proto))
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	p := newTestProxy(t)
+	defer p.Close()
+
+	for _, h2 := range []bool{true, false} {
+		resp, err := p.client(h2).Get(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		want := map[bool]string{true: "HTTP/2.0", false: "HTTP/1.1"}[h2]
+		if resp.Proto != want || string(body) != "HTTP/2.0" {
+			t.Errorf("h2 %v: client got %s, upstream got %s", h2, resp.Proto, body)
+		}
+	}
+
+	list := p.records(t, 2)
+	if list[0].ClientProtocol != "h2" || list[0].UpstreamProtocol != "h2" {
+		t.Errorf("h2 client: %s, upstream %s", list[0].ClientProtocol, list[0].UpstreamProtocol)
+	}
+	if list[1].ClientProtocol != "http/1.1" || list[1].UpstreamProtocol != "h2" {
+		t.Errorf("http/1.1 client: %s, upstream %s", list[1].ClientProtocol, list[1].UpstreamProtocol)
+	}
+}
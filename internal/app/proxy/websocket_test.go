@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/Smet1/golang-proxy/internal/pkg/proxy"
+)
+
+// dialWebSocket opens target through CONNECT to the proxy, with TLS for
+// wss as browsers do.
+func (p *testProxy) dialWebSocket(t *testing.T, target string) *websocket.Conn {
+	u, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", p.srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", u.Host, u.Host)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v, %v", resp, err)
+	}
+
+	var rw io.ReadWriteCloser = conn
+	if u.Scheme == "wss" {
+		rw = tls.Client(conn, &tls.Config{RootCAs: p.roots, ServerName: u.Hostname()})
+	}
+	config, err := websocket.NewConfig(target, "http://"+u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := websocket.NewClient(config, rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ws
+}
+
+// frames waits for the frames of the connection until check accepts them.
+func (p *testProxy) frames(t *testing.T, id string, check func([]*proxy.WebSocketFrame) bool) []*proxy.WebSocketFrame {
+	var frames []*proxy.WebSocketFrame
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		var err error
+		frames, err = p.Store.Frames(id, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check(frames) {
+			return frames
+		}
+	}
+	t.Errorf("unexpected frames:")
+	for _, f := range frames {
+		t.Errorf("%s %d %q", f.Direction, f.Opcode, f.Payload)
+	}
+
+	return frames
+}
+
+func hasFrame(frames []*proxy.WebSocketFrame, direction string, opcode int, payload string) bool {
+	for _, f := range frames {
+		if f.Direction == direction && f.Opcode == opcode && (payload == "" || string(f.Payload) == payload) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestWebSocketCapture(t *testing.T) {
+	echo := websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	})
+
+	for _, tc := range []struct {
+		scheme   string
+		upstream *httptest.Server
+	}{
+		{"ws", httptest.NewServer(echo)},
+		{"wss", httptest.NewTLSServer(echo)},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			defer tc.upstream.Close()
+			p := newTestProxy(t)
+			defer p.Close()
+
+			u, _ := url.Parse(tc.upstream.URL)
+			ws := p.dialWebSocket(t, tc.scheme+"://"+u.Host+"/echo")
+			if err := websocket.Message.Send(ws, "hello"); err != nil {
+				t.Fatal(err)
+			}
+			var reply string
+			if err := websocket.Message.Receive(ws, &reply); err != nil || reply != "hello" {
+				t.Fatalf("got %q, %v", reply, err)
+			}
+
+			// the handshake is saved while the connection is open
+			rs := p.records(t, 1)[0]
+			if rs.Response == nil || rs.Response.StatusCode != http.StatusSwitchingProtocols || rs.URL.Path != "/echo" {
+				t.Fatalf("handshake record %+v", rs)
+			}
+			p.frames(t, rs.ID.Hex(), func(frames []*proxy.WebSocketFrame) bool {
+				return hasFrame(frames, proxy.DirectionClient, 1, "hello") && hasFrame(frames, proxy.DirectionServer, 1, "hello")
+			})
+
+			ws.Close()
+			p.frames(t, rs.ID.Hex(), func(frames []*proxy.WebSocketFrame) bool {
+				return hasFrame(frames, proxy.DirectionClient, 8, "")
+			})
+			for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+				saved, err := p.Store.Get(rs.ID.Hex())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if saved.Response.Duration != 0 {
+					break
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatal("handshake isn't updated on close")
+				}
+			}
+		})
+	}
+}
@@ -37,16 +37,29 @@ func ProxyHTTPClient(proxyURL string) *http.Client {
 
 func HTTPClient() *http.Client {
 	return &http.Client{
-		Transport: &ochttp.Transport{Base: &http.Transport{
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: 30 * time.Second,
-			}).DialContext,
-			MaxIdleConns:          100,
-			IdleConnTimeout:       30 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
-		},
+		Transport: &ochttp.Transport{Base: transport()},
+	}
+}
+
+// TLSHTTPClient is HTTPClient which opens TLS connections with dialTLS.
+func TLSHTTPClient(dialTLS func(network, addr string) (net.Conn, error)) *http.Client {
+	t := transport()
+	t.DialTLS = dialTLS
+
+	return &http.Client{
+		Transport: &ochttp.Transport{Base: t},
+	}
+}
+
+func transport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
 	}
 }
@@ -18,13 +18,13 @@ func WithLogger(ctx context.Context, logger *logrus.Logger) context.Context {
 
 // GetLogger get logger from context
 func GetLogger(ctx context.Context) *logrus.Logger {
-	l, ok := ctx.Value(ctxlog{}).(logrus.Logger)
+	l, ok := ctx.Value(ctxlog{}).(*logrus.Logger)
 	if !ok {
-		l = *logrus.New()
+		l = logrus.New()
 		l.SetOutput(os.Stdout)
 		l.SetLevel(logrus.InfoLevel)
 	}
-	return &l
+	return l
 }
 
 func GetLoggerMiddleware(log *logrus.Logger) func(http.Handler) http.Handler {
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	requestsBucket = []byte("requests")
+	framesBucket   = []byte("frames")
+)
+
+// BoltStore implements Store in a single bolt file. Records are kept as
+// bson documents keyed by the hex form of their id, so the key order is
+// the creation order. Frames are keyed by connection and frame ids.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string, timeout time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't open bolt file")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{requestsBucket, framesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "can't create bucket")
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Save gives records without an id one of their time, which List relies on
+// to walk the history in order.
+func (s *BoltStore) Save(rs *RequestSave) (string, error) {
+	if rs.ID == "" {
+		rs.ID = bson.NewObjectId()
+		if !rs.Time.IsZero() {
+			rs.ID = newObjectIDWithTime(rs.Time)
+		}
+	}
+
+	data, err := bson.Marshal(rs)
+	if err != nil {
+		return "", errors.Wrap(err, "can't marshal request")
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).Put([]byte(rs.ID.Hex()), data)
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "can't put request")
+	}
+
+	return rs.ID.Hex(), nil
+}
+
+func (s *BoltStore) Get(id string) (*RequestSave, error) {
+	rs := &RequestSave{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(requestsBucket).Get([]byte(id))
+		if data == nil {
+			return ErrNotFound
+		}
+
+		return unmarshal(data, rs)
+	})
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get request")
+	}
+
+	return rs, nil
+}
+
+// List orders records by time, then by id, like MongoStore does, so
+// imported records take their place in history. Keys begin with the second
+// the record happened in, so they are walked from the newest or the oldest
+// until offset+limit records pass the filter. The rest of the last second is
+// read too, as records within a second are sorted by time after.
+func (s *BoltStore) List(opts ListOptions) ([]*RequestSave, error) {
+	res := make([]*RequestSave, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(requestsBucket).Cursor()
+		first, next := c.Last, c.Prev
+		if opts.Oldest {
+			first, next = c.First, c.Next
+		}
+
+		var last []byte
+		for k, v := first(); k != nil; k, v = next() {
+			// the timestamp is the first 4 bytes of an id, 8 in hex
+			second := k[:8]
+			if last != nil && !bytes.Equal(second, last) {
+				break
+			}
+
+			rs := &RequestSave{}
+			if err := unmarshal(v, rs); err != nil {
+				return errors.Wrapf(err, "can't unmarshal request %s", k)
+			}
+			if !opts.Filter.Match(rs) {
+				continue
+			}
+			res = append(res, rs)
+			if opts.Limit > 0 && last == nil && len(res) >= opts.Offset+opts.Limit {
+				last = append([]byte(nil), second...)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list requests")
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if opts.Oldest {
+			a, b = b, a
+		}
+		if !a.Time.Equal(b.Time) {
+			return a.Time.After(b.Time)
+		}
+
+		return a.ID > b.ID
+	})
+
+	if opts.Offset >= len(res) {
+		return res[:0], nil
+	}
+	res = res[opts.Offset:]
+	if opts.Limit > 0 && len(res) > opts.Limit {
+		res = res[:opts.Limit]
+	}
+
+	return res, nil
+}
+
+func (s *BoltStore) Delete(id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(requestsBucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		// Keys change while deleting, so they are collected first.
+		var frames [][]byte
+		c := tx.Bucket(framesBucket).Cursor()
+		for k, _ := c.Seek([]byte(id)); k != nil && bytes.HasPrefix(k, []byte(id)); k, _ = c.Next() {
+			frames = append(frames, append([]byte(nil), k...))
+		}
+		for _, k := range frames {
+			if err := tx.Bucket(framesBucket).Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == ErrNotFound {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(err, "can't delete request")
+	}
+
+	return nil
+}
+
+func (s *BoltStore) SaveFrame(f *WebSocketFrame) error {
+	if f.ID == "" {
+		f.ID = bson.NewObjectId()
+	}
+
+	data, err := bson.Marshal(f)
+	if err != nil {
+		return errors.Wrap(err, "can't marshal frame")
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(framesBucket).Put([]byte(f.ConnectionID.Hex()+f.ID.Hex()), data)
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't put frame")
+	}
+
+	return nil
+}
+
+func (s *BoltStore) Frames(connectionID string, offset, limit int) ([]*WebSocketFrame, error) {
+	res := make([]*WebSocketFrame, 0)
+	if !bson.IsObjectIdHex(connectionID) {
+		return res, nil
+	}
+
+	prefix := []byte(connectionID)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(framesBucket).Cursor()
+		skipped := 0
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if limit > 0 && len(res) >= limit {
+				break
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+
+			f := &WebSocketFrame{}
+			if err := unmarshal(v, f); err != nil {
+				return errors.Wrapf(err, "can't unmarshal frame %s", k)
+			}
+			res = append(res, f)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list frames")
+	}
+
+	return res, nil
+}
+
+// unmarshal decodes a value read in a transaction. bson keeps byte slices
+// of its input, which bolt reuses once the transaction is over, so the
+// input is copied.
+func unmarshal(data []byte, v interface{}) error {
+	return bson.Unmarshal(append([]byte(nil), data...), v)
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
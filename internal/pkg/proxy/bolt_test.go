@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ids := make([]string, 0, 3)
+	for _, host := range []string{"a.com", "b.com", "c.com"} {
+		id, err := store.Save(&RequestSave{
+			Method: "GET",
+			Host:   host,
+			URL:    &url.URL{Path: "/"},
+			Body:   []byte("body"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	rs, err := store.Get(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Host != "b.com" || string(rs.Body) != "body" || rs.URL.Path != "/" {
+		t.Errorf("unexpected record %+v", rs)
+	}
+
+	list, err := store.List(ListOptions{Offset: 1, Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Host != "b.com" || list[1].Host != "a.com" {
+		t.Errorf("unexpected list %+v", list)
+	}
+
+	if err = store.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(ids[0]); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err = store.Delete(ids[0]); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestBoltStoreOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	// the imported record is saved last but happened first
+	for _, rs := range []*RequestSave{
+		{Host: "live1.com", Time: now.Add(-time.Minute)},
+		{Host: "live2.com", Time: now},
+		{Host: "imported.com", Time: now.Add(-time.Hour), Imported: true},
+	} {
+		rs.URL = &url.URL{Path: "/"}
+		if _, err := store.Save(rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		opts  ListOptions
+		hosts []string
+	}{
+		{ListOptions{}, []string{"live2.com", "live1.com", "imported.com"}},
+		{ListOptions{Oldest: true}, []string{"imported.com", "live1.com", "live2.com"}},
+		{ListOptions{Oldest: true, Offset: 1, Limit: 1}, []string{"live1.com"}},
+		{ListOptions{Offset: 5}, []string{}},
+	} {
+		list, err := store.List(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hosts := make([]string, 0, len(list))
+		for _, rs := range list {
+			hosts = append(hosts, rs.Host)
+		}
+		if strings.Join(hosts, ",") != strings.Join(tc.hosts, ",") {
+			t.Errorf("%+v: got %v, want %v", tc.opts, hosts, tc.hosts)
+		}
+	}
+}
+
+func TestBoltStoreListStops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		rs := &RequestSave{Host: "example.com", URL: &url.URL{Path: "/"}, Time: now.Add(time.Duration(i) * time.Second)}
+		if _, err := store.Save(rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a broken record an hour ago is only read when the walk gets to it
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(requestsBucket).Put([]byte(newObjectIDWithTime(now.Add(-time.Hour)).Hex()), []byte("broken"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := store.List(ListOptions{Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Time.Unix() != now.Add(time.Second).Unix() {
+		t.Errorf("unexpected page %v", list)
+	}
+	if _, err = store.List(ListOptions{}); err == nil {
+		t.Error("broken record is not read")
+	}
+}
+
+func TestBoltStoreRecordsOutliveTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	body := bytes.Repeat([]byte("body"), 1024)
+	id, err := store.Save(&RequestSave{URL: &url.URL{Path: "/"}, Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List(ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes grow and remap the file under the records read before
+	for i := 0; i < 200; i++ {
+		_, err := store.Save(&RequestSave{URL: &url.URL{Path: "/"}, Body: bytes.Repeat([]byte{byte(i)}, 8192)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = store.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got.Body, body) || !bytes.Equal(list[0].Body, body) {
+		t.Error("body of a read record changed after writes")
+	}
+}
+
+func TestBoltStoreFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	ids := make([]string, 0, 2)
+	for _, host := range []string{"a.com", "b.com"} {
+		rs := &RequestSave{Host: host, URL: &url.URL{Path: "/"}}
+		id, err := store.Save(rs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			f := &WebSocketFrame{ConnectionID: rs.ID, Direction: DirectionClient, Opcode: 1, Fin: true, Payload: []byte(host)}
+			if err = store.SaveFrame(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, id)
+	}
+
+	// saving again updates the record
+	rs, err := store.Get(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Response = &ResponseSave{StatusCode: 101}
+	if _, err = store.Save(rs); err != nil {
+		t.Fatal(err)
+	}
+	list, err := store.List(ListOptions{})
+	if err != nil || len(list) != 2 {
+		t.Fatalf("%d records, %v", len(list), err)
+	}
+	if rs, err = store.Get(ids[0]); err != nil || rs.Response == nil || rs.Response.StatusCode != 101 {
+		t.Errorf("record isn't updated: %+v, %v", rs, err)
+	}
+
+	frames, err := store.Frames(ids[1], 1, 5)
+	if err != nil || len(frames) != 2 || string(frames[0].Payload) != "b.com" {
+		t.Errorf("frames %+v, %v", frames, err)
+	}
+	for _, id := range []string{"", ids[0][:4], "not an id"} {
+		if frames, err = store.Frames(id, 0, 0); err != nil || len(frames) != 0 {
+			t.Errorf("%q: frames %+v, %v", id, frames, err)
+		}
+	}
+
+	if err = store.Delete(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if frames, err = store.Frames(ids[0], 0, 0); err != nil || len(frames) != 0 {
+		t.Errorf("frames of a deleted request %+v, %v", frames, err)
+	}
+	if frames, err = store.Frames(ids[1], 0, 0); err != nil || len(frames) != 3 {
+		t.Errorf("frames of another request %+v, %v", frames, err)
+	}
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BurstOverride describes changes applied to a saved request before it is
+// sent again. Zero fields keep the saved values.
+type BurstOverride struct {
+	Method string `json:"method"`
+	// URL replaces the whole url, Path and Query are applied after it.
+	URL         string              `json:"url"`
+	Path        string              `json:"path"`
+	Query       map[string][]string `json:"query"`
+	RemoveQuery []string            `json:"remove_query"`
+	// SetHeaders replaces, AddHeaders appends, RemoveHeaders deletes.
+	SetHeaders    http.Header `json:"set_headers"`
+	AddHeaders    http.Header `json:"add_headers"`
+	RemoveHeaders []string    `json:"remove_headers"`
+	// Body replaces the body, BodyBase64 does the same for binary data.
+	Body       *string `json:"body"`
+	BodyBase64 []byte  `json:"body_base64"`
+}
+
+// Apply returns a new record made from parent with the override applied.
+func (o *BurstOverride) Apply(parent *RequestSave) (*RequestSave, error) {
+	child := *parent
+	child.ID = bson.NewObjectId()
+	child.ParentID = parent.ID
+	child.Time = time.Now()
+	child.Response = nil
+	child.RequestURI = ""
+	child.Header = cloneHeader(parent.Header)
+
+	u := parent.TargetURL()
+	if o.URL != "" {
+		parsed, err := url.Parse(o.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't parse url")
+		}
+		if parsed.Scheme == "" || parsed.Host == "" {
+			return nil, errors.New("url must be absolute")
+		}
+		u = parsed
+	}
+	if o.Path != "" {
+		u.Path = o.Path
+		u.RawPath = ""
+	}
+	if len(o.Query) != 0 || len(o.RemoveQuery) != 0 {
+		q := u.Query()
+		for k, v := range o.Query {
+			q[k] = v
+		}
+		for _, k := range o.RemoveQuery {
+			q.Del(k)
+		}
+		u.RawQuery = q.Encode()
+	}
+	child.URL = u
+	child.Host = u.Host
+
+	if o.Method != "" {
+		child.Method = strings.ToUpper(o.Method)
+	}
+
+	for k, v := range o.SetHeaders {
+		child.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range o.AddHeaders {
+		for _, vv := range v {
+			child.Header.Add(k, vv)
+		}
+	}
+	for _, k := range o.RemoveHeaders {
+		child.Header.Del(k)
+	}
+
+	switch {
+	case o.BodyBase64 != nil:
+		child.Body = o.BodyBase64
+	case o.Body != nil:
+		child.Body = []byte(*o.Body)
+	}
+	if o.BodyBase64 != nil || o.Body != nil {
+		child.Truncated = false
+		child.ContentLength = int64(len(child.Body))
+		child.TransferEncoding = nil
+		child.Header.Del("Content-Length")
+	}
+
+	return &child, nil
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBurstOverrideApply(t *testing.T) {
+	text := "new body"
+
+	for _, tc := range []struct {
+		name     string
+		override BurstOverride
+		check    func(t *testing.T, child *RequestSave)
+		err      bool
+	}{
+		{
+			name:     "method",
+			override: BurstOverride{Method: "put"},
+			check: func(t *testing.T, child *RequestSave) {
+				if child.Method != "PUT" {
+					t.Errorf("method %s", child.Method)
+				}
+			},
+		},
+		{
+			name:     "url",
+			override: BurstOverride{URL: "http://other.com:8080/x?b=2"},
+			check: func(t *testing.T, child *RequestSave) {
+				if child.URL.String() != "http://other.com:8080/x?b=2" || child.Host != "other.com:8080" {
+					t.Errorf("url %s, host %s", child.URL, child.Host)
+				}
+			},
+		},
+		{
+			name:     "relative url",
+			override: BurstOverride{URL: "/x"},
+			err:      true,
+		},
+		{
+			name: "path and query",
+			override: BurstOverride{
+				Path:        "/v2",
+				Query:       map[string][]string{"c": {"3"}},
+				RemoveQuery: []string{"a"},
+			},
+			check: func(t *testing.T, child *RequestSave) {
+				if child.URL.String() != "https://example.com/v2?c=3" {
+					t.Errorf("url %s", child.URL)
+				}
+			},
+		},
+		{
+			name: "headers",
+			override: BurstOverride{
+				SetHeaders:    http.Header{"x-set": {"1"}},
+				AddHeaders:    http.Header{"Accept": {"text/html"}},
+				RemoveHeaders: []string{"cookie"},
+			},
+			check: func(t *testing.T, child *RequestSave) {
+				if child.Header.Get("X-Set") != "1" || len(child.Header["Accept"]) != 2 || child.Header.Get("Cookie") != "" {
+					t.Errorf("header %v", child.Header)
+				}
+			},
+		},
+		{
+			name:     "body",
+			override: BurstOverride{Body: &text},
+			check: func(t *testing.T, child *RequestSave) {
+				if string(child.Body) != text || child.ContentLength != int64(len(text)) ||
+					child.Header.Get("Content-Length") != "" || child.TransferEncoding != nil {
+					t.Errorf("body %q, length %d, header %v", child.Body, child.ContentLength, child.Header)
+				}
+			},
+		},
+		{
+			name:     "binary body wins",
+			override: BurstOverride{Body: &text, BodyBase64: []byte{0, 1}},
+			check: func(t *testing.T, child *RequestSave) {
+				if string(child.Body) != "\x00\x01" || child.ContentLength != 2 {
+					t.Errorf("body %q", child.Body)
+				}
+			},
+		},
+		{
+			name: "nothing",
+			check: func(t *testing.T, child *RequestSave) {
+				if child.Method != "POST" || child.URL.String() != "https://example.com/v1?a=1" || string(child.Body) != "old" {
+					t.Errorf("changed %+v", child)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := &RequestSave{
+				ID:               bson.NewObjectId(),
+				Method:           "POST",
+				URL:              &url.URL{Scheme: "https", Host: "example.com", Path: "/v1", RawQuery: "a=1"},
+				Host:             "example.com",
+				Header:           http.Header{"Cookie": {"a=b"}, "Accept": {"*/*"}, "Content-Length": {"3"}},
+				Body:             []byte("old"),
+				ContentLength:    3,
+				TransferEncoding: []string{"chunked"},
+				RequestURI:       "/v1?a=1",
+				Response:         &ResponseSave{StatusCode: 200},
+			}
+
+			child, err := tc.override.Apply(parent)
+			if tc.err {
+				if err == nil {
+					t.Error("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if child.ID == parent.ID || child.ParentID != parent.ID || child.Response != nil || child.RequestURI != "" {
+				t.Errorf("not a new child record %+v", child)
+			}
+			if parent.Header.Get("Cookie") != "a=b" || len(parent.Header["Accept"]) != 1 || parent.URL.Path != "/v1" {
+				t.Errorf("parent changed %+v", parent)
+			}
+			if tc.check != nil {
+				tc.check(t, child)
+			}
+		})
+	}
+}
@@ -0,0 +1,548 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// curlSkipHeaders are not worth copying to a curl command, curl sets them
+// itself or they only make sense for the proxy hop.
+var curlSkipHeaders = map[string]bool{
+	"Content-Length":   true,
+	"Connection":       true,
+	"Proxy-Connection": true,
+}
+
+// curlArgOptions are curl options which take an argument but do not change
+// the request. They are skipped along with the argument when parsing.
+var curlArgOptions = map[string]bool{
+	"-o": true, "--output": true,
+	"-x": true, "--proxy": true,
+	"-m": true, "--max-time": true,
+	"--connect-timeout": true,
+	"-w":                true, "--write-out": true,
+	"--cacert": true, "--cert": true, "--key": true,
+	"-r": true, "--range": true,
+	"--resolve": true,
+	"-c":        true, "--cookie-jar": true,
+	"--retry": true,
+}
+
+// ToCurl renders rs as a curl command which is safe to paste into a shell.
+// Bodies which aren't printable are piped to curl from printf.
+func ToCurl(rs *RequestSave) string {
+	parts := []string{"curl"}
+	if rs.Method != "" && rs.Method != http.MethodGet {
+		parts = append(parts, "-X", shellQuote(rs.Method))
+	}
+	parts = append(parts, shellQuote(rs.TargetURL().String()))
+
+	keys := make([]string, 0, len(rs.Header))
+	for k := range rs.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if curlSkipHeaders[k] {
+			continue
+		}
+		for _, v := range rs.Header[k] {
+			parts = append(parts, "-H", shellQuote(k+": "+v))
+		}
+	}
+
+	if len(rs.Body) == 0 {
+		return strings.Join(parts, " ")
+	}
+	if printable(string(rs.Body)) {
+		parts = append(parts, "--data-binary", shellQuote(string(rs.Body)))
+
+		return strings.Join(parts, " ")
+	}
+
+	// Shells cut $'...' at NUL, so binary bodies come from printf.
+	parts = append(parts, "--data-binary", "@-")
+
+	return "printf " + printfQuote(rs.Body) + " | " + strings.Join(parts, " ")
+}
+
+func printable(s string) bool {
+	for _, r := range s {
+		if !unicode.IsPrint(r) || r == unicode.ReplacementChar {
+			return false
+		}
+	}
+
+	return true
+}
+
+// printfQuote makes a printf format printing b as is, in single quotes
+// with octal escapes for everything but printable ASCII.
+func printfQuote(b []byte) string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('\'')
+	for _, c := range b {
+		switch {
+		case c == '%':
+			buf.WriteString("%%")
+		case c == '\\':
+			buf.WriteString(`\\`)
+		case c == '\'':
+			buf.WriteString(`\047`)
+		case c >= 0x20 && c < 0x7f:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, `\%03o`, c)
+		}
+	}
+	buf.WriteByte('\'')
+
+	return buf.String()
+}
+
+// printfUnquote prints a printf format without arguments, as a shell does.
+func printfUnquote(format string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		switch {
+		case c == '%':
+			if i+1 >= len(format) || format[i+1] != '%' {
+				return nil, errors.New("printf format must have no conversions")
+			}
+			buf.WriteByte('%')
+			i++
+		case c == '\\' && i+1 < len(format):
+			i++
+			if o := format[i]; o >= '0' && o <= '7' {
+				n := 0
+				for j := 0; j < 3 && i < len(format) && format[i] >= '0' && format[i] <= '7'; j++ {
+					n = n*8 + int(format[i]-'0')
+					i++
+				}
+				i--
+				buf.WriteByte(byte(n))
+				continue
+			}
+			if e, ok := printfEscapes[format[i]]; ok {
+				buf.WriteByte(e)
+			} else {
+				buf.WriteByte('\\')
+				buf.WriteByte(format[i])
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+var printfEscapes = map[byte]byte{
+	'\\': '\\', 'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+}
+
+// shellQuote wraps s in single quotes, or in $'...' when s has characters
+// which can't be typed inside single quotes.
+func shellQuote(s string) string {
+	if printable(s) {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(buf, `\x%02x`, c)
+		}
+	}
+	buf.WriteByte('\'')
+
+	return buf.String()
+}
+
+// ParseCurl makes a request record from a curl command line.
+func ParseCurl(command string) (*RequestSave, error) {
+	args, err := shellSplit(command)
+	if err != nil {
+		return nil, err
+	}
+	// printf '...' | curl ... --data-binary @- as made by ToCurl
+	var stdin []byte
+	if len(args) > 3 && args[0] == "printf" && args[2] == "|" {
+		stdin, err = printfUnquote(args[1])
+		if err != nil {
+			return nil, err
+		}
+		args = args[3:]
+	}
+	if len(args) == 0 || args[0] != "curl" {
+		return nil, errors.New("command must start with curl")
+	}
+
+	var (
+		method, rawURL string
+		data           []string
+		get, head      bool
+		header         = http.Header{}
+	)
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := arg, "", false
+		switch {
+		case strings.HasPrefix(arg, "--") && strings.Contains(arg, "="):
+			parts := strings.SplitN(arg, "=", 2)
+			name, value, hasValue = parts[0], parts[1], true
+		case len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && strings.ContainsRune("XHdbAeu", rune(arg[1])):
+			name, value, hasValue = arg[:2], arg[2:], true
+		}
+
+		next := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", errors.Errorf("%s needs an argument", name)
+			}
+			i++
+
+			return args[i], nil
+		}
+
+		switch name {
+		case "-X", "--request":
+			method, err = next()
+		case "-H", "--header":
+			var h string
+			h, err = next()
+			if parts := strings.SplitN(h, ":", 2); err == nil && len(parts) == 2 {
+				header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			}
+		case "-d", "--data", "--data-raw", "--data-binary", "--data-ascii", "--data-urlencode":
+			var d string
+			d, err = next()
+			switch {
+			case d == "@-" && name != "--data-urlencode":
+				if stdin == nil {
+					return nil, errors.New("body is read from stdin")
+				}
+				d = string(stdin)
+			case name == "--data-urlencode":
+				d = curlURLEncode(d)
+			}
+			data = append(data, d)
+		case "-b", "--cookie":
+			var c string
+			c, err = next()
+			header.Add("Cookie", c)
+		case "-A", "--user-agent":
+			var ua string
+			ua, err = next()
+			header.Set("User-Agent", ua)
+		case "-e", "--referer":
+			var ref string
+			ref, err = next()
+			header.Set("Referer", ref)
+		case "-u", "--user":
+			var user string
+			user, err = next()
+			parts := strings.SplitN(user, ":", 2)
+			req := &http.Request{Header: http.Header{}}
+			req.SetBasicAuth(parts[0], strings.Join(parts[1:], ""))
+			header.Set("Authorization", req.Header.Get("Authorization"))
+		case "--url":
+			rawURL, err = next()
+		case "-G", "--get":
+			get = true
+		case "-I", "--head":
+			head = true
+		default:
+			switch {
+			case curlArgOptions[name]:
+				_, err = next()
+			case strings.HasPrefix(arg, "-"):
+			case rawURL == "":
+				rawURL = arg
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rawURL == "" {
+		return nil, errors.New("no url in command")
+	}
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse url")
+	}
+
+	body := strings.Join(data, "&")
+	switch {
+	case get && body != "":
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += body
+		body = ""
+	case body != "" && header.Get("Content-Type") == "":
+		header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	if method == "" {
+		switch {
+		case head:
+			method = http.MethodHead
+		case body != "":
+			method = http.MethodPost
+		default:
+			method = http.MethodGet
+		}
+	}
+
+	req, err := http.NewRequest(method, u.String(), strings.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't make request")
+	}
+	req.Header = header
+	if host := header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	rs, err := NewRequestSave(req)
+	if err != nil {
+		return nil, err
+	}
+	rs.Imported = true
+
+	return rs, nil
+}
+
+// curlURLEncode encodes --data-urlencode argument the way curl does:
+// "content", "=content" and "name=content" forms are supported.
+func curlURLEncode(d string) string {
+	i := strings.Index(d, "=")
+	if i < 0 {
+		return url.QueryEscape(d)
+	}
+	if i == 0 {
+		return url.QueryEscape(d[1:])
+	}
+
+	return d[:i] + "=" + url.QueryEscape(d[i+1:])
+}
+
+// shellSplit splits a command line into words like a POSIX shell would,
+// supporting single, double and $'...' quotes and line continuations.
+func shellSplit(s string) ([]string, error) {
+	var (
+		words  []string
+		buf    bytes.Buffer
+		inWord bool
+		runes  = []rune(s)
+		flush  = func() {
+			if inWord {
+				words = append(words, buf.String())
+				buf.Reset()
+				inWord = false
+			}
+		}
+	)
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes):
+			i++
+			if runes[i] != '\n' && runes[i] != '\r' {
+				buf.WriteRune(runes[i])
+				inWord = true
+			}
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			buf.WriteString(string(runes[i+1 : end]))
+			inWord = true
+			i = end
+		case r == '$' && i+1 < len(runes) && runes[i+1] == '\'':
+			n, err := readANSIQuoted(runes[i+2:], &buf)
+			if err != nil {
+				return nil, err
+			}
+			inWord = true
+			i += 2 + n
+		case r == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				buf.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, errors.New("unterminated double quote")
+			}
+			inWord = true
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			buf.WriteRune(r)
+			inWord = true
+		}
+	}
+	flush()
+
+	return words, nil
+}
+
+// readANSIQuoted reads the body of $'...' up to and including the closing
+// quote and returns the number of runes consumed.
+func readANSIQuoted(runes []rune, buf *bytes.Buffer) (int, error) {
+	escapes := map[rune]byte{
+		'n': '\n', 't': '\t', 'r': '\r', '0': 0, 'a': '\a', 'b': '\b', 'e': 0x1b, 'f': '\f', 'v': '\v',
+		'\\': '\\', '\'': '\'', '"': '"',
+	}
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '\'':
+			return i, nil
+		case '\\':
+			if i+1 >= len(runes) {
+				return 0, errors.New("unterminated $' quote")
+			}
+			i++
+			if runes[i] == 'x' {
+				var c byte
+				n := 0
+				for ; n < 2 && i+1 < len(runes) && isHex(runes[i+1]); n++ {
+					i++
+					c = c<<4 | hexValue(runes[i])
+				}
+				buf.WriteByte(c)
+				continue
+			}
+			if c, ok := escapes[runes[i]]; ok {
+				buf.WriteByte(c)
+				continue
+			}
+			buf.WriteRune('\\')
+			buf.WriteRune(runes[i])
+		default:
+			buf.WriteRune(runes[i])
+		}
+	}
+
+	return 0, errors.New("unterminated $' quote")
+}
+
+func indexRune(runes []rune, from int, r rune) int {
+	for i := from; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isHex(r rune) bool {
+	return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
+func hexValue(r rune) byte {
+	switch {
+	case r >= 'a':
+		return byte(r-'a') + 10
+	case r >= 'A':
+		return byte(r-'A') + 10
+	default:
+		return byte(r - '0')
+	}
+}
+
+// GetCurlHandler returns handler for GET /requests/{id}/curl.
+func GetCurlHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		id := mux.Vars(req)["id"]
+
+		rs, err := store.Get(id)
+		if err == ErrNotFound {
+			ErrResponse(res, http.StatusNotFound, "request not found")
+
+			log.WithField("id", id).Error("request not found")
+			return
+		}
+		if err != nil {
+			ErrResponse(res, http.StatusInternalServerError, "can't get request")
+
+			log.WithError(err).Error("can't get request")
+			return
+		}
+
+		res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		res.WriteHeader(http.StatusOK)
+		_, _ = res.Write([]byte(ToCurl(rs) + "\n"))
+	}
+}
+
+// GetCurlImportHandler returns handler for POST /requests/import/curl,
+// which saves the curl command from the body as a new request.
+func GetCurlImportHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't read body")
+
+			log.WithError(err).Error("can't read body")
+			return
+		}
+
+		rs, err := ParseCurl(string(b))
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("can't parse curl")
+			return
+		}
+
+		id, err := store.Save(rs)
+		if err != nil {
+			ErrResponse(res, http.StatusInternalServerError, "can't save request")
+
+			log.WithError(err).Error("can't save request")
+			return
+		}
+
+		OkResponse(res, NewRequestSummary(rs))
+		log.WithField("id", id).Info("imported curl")
+	}
+}
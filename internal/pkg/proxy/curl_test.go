@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"testing"
+)
+
+func TestParseCurl(t *testing.T) {
+	rs, err := ParseCurl(`curl 'https://example.com/api?a=1' \
+  -H 'Accept: application/json' -H "X-Quote: it's" \
+  -b 'session=1' --compressed -s \
+  --data-raw $'{"a":\n1}'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rs.Method != http.MethodPost {
+		t.Errorf("expected POST, got %s", rs.Method)
+	}
+	if u := rs.TargetURL().String(); u != "https://example.com/api?a=1" {
+		t.Errorf("unexpected url %s", u)
+	}
+	if rs.Header.Get("X-Quote") != "it's" || rs.Header.Get("Cookie") != "session=1" {
+		t.Errorf("unexpected headers %v", rs.Header)
+	}
+	if string(rs.Body) != "{\"a\":\n1}" {
+		t.Errorf("unexpected body %q", rs.Body)
+	}
+}
+
+func TestCurlRoundTrip(t *testing.T) {
+	saved := &RequestSave{
+		Method: http.MethodPut,
+		URL:    &url.URL{Scheme: "http", Host: "example.com", Path: "/it's"},
+		Host:   "example.com",
+		Header: http.Header{"X-A": {"1"}, "Content-Length": {"3"}},
+		Body:   []byte{'a', 0, '\''},
+	}
+
+	rs, err := ParseCurl(ToCurl(saved))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Method != saved.Method || rs.TargetURL().String() != saved.TargetURL().String() {
+		t.Errorf("unexpected request %s %s", rs.Method, rs.TargetURL())
+	}
+	if rs.Header.Get("X-A") != "1" || string(rs.Body) != string(saved.Body) {
+		t.Errorf("unexpected request %v %q", rs.Header, rs.Body)
+	}
+}
+
+func TestCurlInShell(t *testing.T) {
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("no curl")
+	}
+
+	bodies := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies <- body
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	for _, body := range [][]byte{
+		[]byte("text with 'quotes' and $HOME"),
+		{'a', 0, '\''},
+		[]byte("100% \\n not a newline\n"),
+		all,
+	} {
+		cmd := ToCurl(&RequestSave{
+			Method: http.MethodPost,
+			URL:    &url.URL{Scheme: "http", Host: u.Host, Path: "/"},
+			Host:   u.Host,
+			Body:   body,
+		})
+		out, err := exec.Command("sh", "-c", cmd+" -s -S").CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", cmd, err, out)
+		}
+		if got := <-bodies; !bytes.Equal(got, body) {
+			t.Errorf("%s: server got %q", cmd, got)
+		}
+
+		rs, err := ParseCurl(cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rs.Body, body) {
+			t.Errorf("%s: parsed %q", cmd, rs.Body)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// decodeBody undoes the Content-Encoding in h, so the body can be read and
+// edited, and removes the header. Bodies in other encodings than gzip and
+// deflate are returned as they are with false.
+func decodeBody(h http.Header, body []byte) ([]byte, bool, error) {
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+
+	var r io.Reader
+	switch encoding {
+	case "", "identity":
+		h.Del("Content-Encoding")
+		return body, true, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, false, errors.Wrap(err, "can't read gzip body")
+		}
+		r = zr
+	case "deflate":
+		// deflate is zlib by the spec, but some servers send raw deflate
+		zr, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			r = flate.NewReader(bytes.NewReader(body))
+		} else {
+			r = zr
+		}
+	default:
+		return body, false, nil
+	}
+
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "can't decode %s body", encoding)
+	}
+	h.Del("Content-Encoding")
+
+	return decoded, true, nil
+}
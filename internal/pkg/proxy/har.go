@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/Smet1/golang-proxy/internal/pkg/har"
+)
+
+const (
+	harCreator        = "golang-proxy"
+	harCreatorVersion = "1.0"
+)
+
+// SelectRequests returns saved requests by ids or, when ids are empty, all
+// requests passing the filter, oldest first.
+func SelectRequests(store Store, ids []string, f Filter) ([]*RequestSave, error) {
+	if len(ids) == 0 {
+		return store.List(ListOptions{Filter: f, Oldest: true})
+	}
+
+	res := make([]*RequestSave, 0, len(ids))
+	for _, id := range ids {
+		rs, err := store.Get(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't get request %s", id)
+		}
+		res = append(res, rs)
+	}
+
+	return res, nil
+}
+
+// ToHAR renders saved requests as a HAR document.
+func ToHAR(list []*RequestSave) *har.HAR {
+	doc := &har.HAR{Log: har.Log{
+		Version: har.Version,
+		Creator: har.Creator{Name: harCreator, Version: harCreatorVersion},
+		Entries: make([]har.Entry, 0, len(list)),
+	}}
+	for _, rs := range list {
+		doc.Log.Entries = append(doc.Log.Entries, harEntry(rs))
+	}
+
+	return doc
+}
+
+func harEntry(rs *RequestSave) har.Entry {
+	u := rs.TargetURL()
+	entry := har.Entry{
+		StartedDateTime: rs.Time.Format(time.RFC3339Nano),
+		Request: har.Request{
+			Method:      rs.Method,
+			URL:         u.String(),
+			HTTPVersion: rs.Proto,
+			Cookies:     harCookies((&http.Request{Header: rs.Header}).Cookies()),
+			Headers:     harHeaders(rs.Header),
+			QueryString: harValues(u.Query()),
+			HeadersSize: -1,
+			BodySize:    len(rs.Body),
+		},
+		Response: har.Response{
+			HTTPVersion: rs.Proto,
+			Cookies:     []har.Cookie{},
+			Headers:     []har.NameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: har.Timings{Blocked: -1, DNS: -1, Connect: -1, SSL: -1},
+	}
+
+	if len(rs.Body) != 0 {
+		contentType := rs.Header.Get("Content-Type")
+		text, encoding := harText(rs.Body)
+		entry.Request.PostData = &har.PostData{
+			MimeType: contentType,
+			Params:   []har.NameValue{},
+			Text:     text,
+			Encoding: encoding,
+		}
+		if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+			if form, err := url.ParseQuery(string(rs.Body)); err == nil {
+				entry.Request.PostData.Params = harValues(form)
+			}
+		}
+	}
+
+	resp := rs.Response
+	if resp == nil {
+		return entry
+	}
+
+	// the content is what the client sees after the Content-Encoding is undone
+	body := resp.Body
+	if decoded, _, err := decodeBody(cloneHeader(resp.Header), resp.Body); err == nil {
+		body = decoded
+	}
+
+	text, encoding := harText(body)
+	entry.Response.Status = resp.StatusCode
+	entry.Response.StatusText = http.StatusText(resp.StatusCode)
+	entry.Response.Cookies = harCookies((&http.Response{Header: resp.Header}).Cookies())
+	entry.Response.Headers = harHeaders(resp.Header)
+	entry.Response.Content = har.Content{
+		Size:     len(body),
+		MimeType: resp.Header.Get("Content-Type"),
+		Text:     text,
+		Encoding: encoding,
+	}
+	entry.Response.RedirectURL = resp.Header.Get("Location")
+	entry.Response.BodySize = len(resp.Body)
+	entry.Response.Error = resp.Error
+
+	entry.Time = milliseconds(resp.Duration)
+	entry.Timings.Wait = milliseconds(resp.TTFB)
+	entry.Timings.Receive = milliseconds(resp.Duration - resp.TTFB)
+
+	return entry
+}
+
+// harText returns body as is when it is valid utf-8 and base64 otherwise.
+func harText(body []byte) (text, encoding string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func harHeaders(h http.Header) []har.NameValue {
+	res := make([]har.NameValue, 0, len(h))
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			res = append(res, har.NameValue{Name: k, Value: v})
+		}
+	}
+
+	return res
+}
+
+func harValues(values url.Values) []har.NameValue {
+	return harHeaders(http.Header(values))
+}
+
+func harCookies(cookies []*http.Cookie) []har.Cookie {
+	res := make([]har.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		hc := har.Cookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			hc.Expires = c.Expires.Format(time.RFC3339)
+		}
+		res = append(res, hc)
+	}
+
+	return res
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// GetHARHandler returns handler for GET /har. Requests are selected by the
+// comma separated ids or by the filters accepted by GET /requests.
+func GetHARHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		query := req.URL.Query()
+
+		f, err := parseFilter(query)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("bad filter")
+			return
+		}
+
+		list, err := SelectRequests(store, SplitIDs(query.Get("ids")), f)
+		if errors.Cause(err) == ErrNotFound {
+			ErrResponse(res, http.StatusNotFound, "request not found")
+
+			log.WithError(err).Error("request not found")
+			return
+		}
+		if err != nil {
+			ErrResponse(res, http.StatusInternalServerError, "can't select requests")
+
+			log.WithError(err).Error("can't select requests")
+			return
+		}
+
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "proxy.har"))
+		OkResponse(res, ToHAR(list))
+	}
+}
+
+// ImportHAR saves every entry of the HAR document read from r as a new
+// imported request and returns their ids.
+func ImportHAR(store Store, r io.Reader) ([]string, error) {
+	doc := &har.HAR{}
+	if err := json.NewDecoder(r).Decode(doc); err != nil {
+		return nil, errors.Wrap(err, "can't decode har")
+	}
+
+	ids := make([]string, 0, len(doc.Log.Entries))
+	for i := range doc.Log.Entries {
+		rs, err := fromHAREntry(&doc.Log.Entries[i])
+		if err != nil {
+			return ids, errors.Wrapf(err, "can't convert entry %d", i)
+		}
+
+		id, err := store.Save(rs)
+		if err != nil {
+			return ids, errors.Wrapf(err, "can't save entry %d", i)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func fromHAREntry(entry *har.Entry) (*RequestSave, error) {
+	started, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse startedDateTime")
+	}
+
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't parse url")
+	}
+
+	rs := &RequestSave{
+		ID:         newObjectIDWithTime(started),
+		Method:     entry.Request.Method,
+		URL:        u,
+		Header:     fromHARHeaders(entry.Request.Headers),
+		Host:       u.Host,
+		RequestURI: u.RequestURI(),
+		Time:       started,
+		Imported:   true,
+	}
+
+	var ok bool
+	rs.ProtoMajor, rs.ProtoMinor, ok = http.ParseHTTPVersion(strings.ToUpper(entry.Request.HTTPVersion))
+	rs.Proto = strings.ToUpper(entry.Request.HTTPVersion)
+	if !ok {
+		rs.Proto, rs.ProtoMajor, rs.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+
+	if pd := entry.Request.PostData; pd != nil {
+		switch {
+		case pd.Text != "":
+			rs.Body, err = fromHARText(pd.Text, pd.Encoding)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't decode post data")
+			}
+		case len(pd.Params) != 0:
+			form := url.Values{}
+			for _, p := range pd.Params {
+				form.Add(p.Name, p.Value)
+			}
+			rs.Body = []byte(form.Encode())
+		}
+		if pd.MimeType != "" && rs.Header.Get("Content-Type") == "" {
+			rs.Header.Set("Content-Type", pd.MimeType)
+		}
+	}
+	rs.ContentLength = int64(len(rs.Body))
+
+	if entry.Response.Status == 0 && entry.Response.Error == "" {
+		return rs, nil
+	}
+
+	body, err := fromHARText(entry.Response.Content.Text, entry.Response.Content.Encoding)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't decode response content")
+	}
+	header := fromHARHeaders(entry.Response.Headers)
+	// the content is decoded by the spec, so the encoding header no longer applies
+	if _, _, err := decodeBody(cloneHeader(header), body); err != nil {
+		header.Del("Content-Encoding")
+	}
+	rs.Response = &ResponseSave{
+		StatusCode: entry.Response.Status,
+		Header:     header,
+		Body:       body,
+		Trailer:    http.Header{},
+		TTFB:       fromMilliseconds(entry.Timings.Wait),
+		Duration:   fromMilliseconds(entry.Time),
+		Error:      entry.Response.Error,
+	}
+
+	return rs, nil
+}
+
+func fromHARText(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+
+	return []byte(text), nil
+}
+
+// fromHARHeaders skips HTTP/2 pseudo headers such as :authority.
+func fromHARHeaders(headers []har.NameValue) http.Header {
+	h := http.Header{}
+	for _, nv := range headers {
+		if strings.HasPrefix(nv.Name, ":") {
+			continue
+		}
+		h.Add(nv.Name, nv.Value)
+	}
+
+	return h
+}
+
+func fromMilliseconds(ms float64) time.Duration {
+	if ms < 0 {
+		return 0
+	}
+
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// newObjectIDWithTime returns a unique id which sorts as if it was created
+// at t, so imported requests keep their place in the history.
+func newObjectIDWithTime(t time.Time) bson.ObjectId {
+	id := []byte(bson.NewObjectId())
+	binary.BigEndian.PutUint32(id[:4], uint32(t.Unix()))
+
+	return bson.ObjectId(id)
+}
+
+// GetHARImportHandler returns handler for POST /har, which imports the HAR
+// document from the body.
+func GetHARImportHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+
+		ids, err := ImportHAR(store, req.Body)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).WithField("imported", len(ids)).Error("can't import har")
+			return
+		}
+
+		OkResponse(res, ids)
+	}
+}
+
+// SplitIDs splits comma separated ids skipping empty ones.
+func SplitIDs(s string) []string {
+	ids := make([]string, 0)
+	for _, id := range strings.Split(s, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
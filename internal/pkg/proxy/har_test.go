@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHARRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "har")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	started := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	saved := &RequestSave{
+		Method: http.MethodPost,
+		URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/api", RawQuery: "a=1"},
+		Proto:  "HTTP/1.1",
+		Header: http.Header{"Content-Type": {"application/octet-stream"}, "Cookie": {"session=1"}},
+		Body:   []byte{0xff, 0x00, 0x01},
+		Host:   "example.com",
+		Time:   started,
+		Response: &ResponseSave{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       []byte("ok"),
+			TTFB:       10 * time.Millisecond,
+			Duration:   15 * time.Millisecond,
+		},
+	}
+
+	doc := ToHAR([]*RequestSave{saved})
+	if doc.Log.Entries[0].Request.PostData.Encoding != "base64" {
+		t.Errorf("binary body is not base64 encoded")
+	}
+	if len(doc.Log.Entries[0].Request.Cookies) != 1 {
+		t.Errorf("cookies are not exported")
+	}
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := ImportHAR(store, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs, err := store.Get(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Imported || !rs.Time.Equal(started) || !rs.ID.Time().Equal(started) {
+		t.Errorf("imported record lost its time: %v %v", rs.Time, rs.ID.Time())
+	}
+	if rs.TargetURL().String() != "https://example.com/api?a=1" {
+		t.Errorf("unexpected url %s", rs.TargetURL())
+	}
+	if !bytes.Equal(rs.Body, saved.Body) || string(rs.Response.Body) != "ok" {
+		t.Errorf("bodies differ: %v %q", rs.Body, rs.Response.Body)
+	}
+	if rs.Response.TTFB != saved.Response.TTFB || rs.Response.Duration != saved.Response.Duration {
+		t.Errorf("timings differ: %v %v", rs.Response.TTFB, rs.Response.Duration)
+	}
+}
+
+func TestHARDecodesContent(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte("hello, world"))
+	zw.Close()
+
+	saved := &RequestSave{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "http", Host: "example.com", Path: "/"},
+		Proto:  "HTTP/1.1",
+		Header: http.Header{},
+		Host:   "example.com",
+		Response: &ResponseSave{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Encoding": {"gzip"}},
+			Body:       buf.Bytes(),
+		},
+	}
+
+	resp := harEntry(saved).Response
+	if resp.Content.Text != "hello, world" || resp.Content.Size != len("hello, world") {
+		t.Errorf("content is not decoded: %d %q", resp.Content.Size, resp.Content.Text)
+	}
+	if resp.BodySize != buf.Len() {
+		t.Errorf("body size %d is not the transferred %d", resp.BodySize, buf.Len())
+	}
+	if saved.Response.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("saved headers are changed")
+	}
+
+	entry := harEntry(saved)
+	rs, err := fromHAREntry(&entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Response.Header.Get("Content-Encoding") != "" || string(rs.Response.Body) != "hello, world" {
+		t.Errorf("imported response is inconsistent: %v %q", rs.Response.Header, rs.Response.Body)
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 1000
+)
+
+type RequestSummary struct {
+	ID            string        `json:"id"`
+	Time          time.Time     `json:"time"`
+	Method        string        `json:"method"`
+	Scheme        string        `json:"scheme"`
+	Host          string        `json:"host"`
+	Path          string        `json:"path"`
+	StatusCode    int           `json:"status_code,omitempty"`
+	ContentType   string        `json:"content_type,omitempty"`
+	ContentLength int           `json:"content_length"`
+	Duration      time.Duration `json:"duration"`
+}
+
+func NewRequestSummary(rs *RequestSave) RequestSummary {
+	sum := RequestSummary{
+		ID:     rs.ID.Hex(),
+		Time:   rs.Time,
+		Method: rs.Method,
+		Host:   rs.Host,
+	}
+	if rs.URL != nil {
+		sum.Scheme = rs.URL.Scheme
+		sum.Path = rs.URL.Path
+	}
+	if rs.Response != nil {
+		sum.StatusCode = rs.Response.StatusCode
+		sum.ContentType = rs.Response.Header.Get("Content-Type")
+		sum.ContentLength = len(rs.Response.Body)
+		sum.Duration = rs.Response.Duration
+	}
+
+	return sum
+}
+
+// GetListHandler returns handler for GET /requests. It accepts offset,
+// limit, sort (time or -time) and the filters described by parseFilter.
+func GetListHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+
+		opts, err := parseListOptions(req.URL.Query())
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("bad list options")
+			return
+		}
+
+		list, err := store.List(opts)
+		if err != nil {
+			ErrResponse(res, http.StatusInternalServerError, "can't list requests")
+
+			log.WithError(err).Error("can't list requests")
+			return
+		}
+
+		summaries := make([]RequestSummary, 0, len(list))
+		for _, rs := range list {
+			summaries = append(summaries, NewRequestSummary(rs))
+		}
+		OkResponse(res, summaries)
+	}
+}
+
+// GetRequestHandler returns handler for GET /requests/{id}.
+func GetRequestHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		id := mux.Vars(req)["id"]
+
+		rs, err := store.Get(id)
+		if err == ErrNotFound {
+			ErrResponse(res, http.StatusNotFound, "request not found")
+
+			log.WithField("id", id).Error("request not found")
+			return
+		}
+		if err != nil {
+			ErrResponse(res, http.StatusInternalServerError, "can't get request")
+
+			log.WithError(err).Error("can't get request")
+			return
+		}
+		OkResponse(res, rs)
+	}
+}
+
+func parseListOptions(query url.Values) (ListOptions, error) {
+	opts := ListOptions{Limit: defaultListLimit}
+
+	var err error
+	if v := query.Get("offset"); v != "" {
+		opts.Offset, err = strconv.Atoi(v)
+		if err != nil || opts.Offset < 0 {
+			return opts, errors.New("offset must be a non-negative number")
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		opts.Limit, err = strconv.Atoi(v)
+		if err != nil || opts.Limit <= 0 || opts.Limit > maxListLimit {
+			return opts, errors.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+	}
+
+	switch query.Get("sort") {
+	case "", "-time":
+	case "time":
+		opts.Oldest = true
+	default:
+		return opts, errors.New("sort must be either time or -time")
+	}
+
+	opts.Filter, err = parseFilter(query)
+
+	return opts, err
+}
+
+// parseFilter reads host, method, path, status, content_type and the
+// RFC 3339 from/to time range.
+func parseFilter(query url.Values) (Filter, error) {
+	f := Filter{
+		Host:        query.Get("host"),
+		Method:      query.Get("method"),
+		Path:        query.Get("path"),
+		ContentType: query.Get("content_type"),
+	}
+
+	var err error
+	if v := query.Get("status"); v != "" {
+		f.StatusCode, err = strconv.Atoi(v)
+		if err != nil {
+			return f, errors.New("status must be a number")
+		}
+	}
+	if v := query.Get("from"); v != "" {
+		f.From, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.New("from must be RFC 3339 time")
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		f.To, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.New("to must be RFC 3339 time")
+		}
+	}
+
+	return f, nil
+}
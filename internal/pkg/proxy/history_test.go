@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	now := time.Now()
+	rs := &RequestSave{
+		Method: "POST",
+		Host:   "api.example.com:8443",
+		URL:    &url.URL{Path: "/v1/users"},
+		Time:   now,
+		Response: &ResponseSave{
+			StatusCode: 201,
+			Header:     http.Header{"Content-Type": {"application/json; charset=utf-8"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"empty", Filter{}, true},
+		{"host with port", Filter{Host: "API.example.com:8443"}, true},
+		{"host without port", Filter{Host: "api.example.com"}, true},
+		{"other host", Filter{Host: "example.com"}, false},
+		{"method", Filter{Method: "post"}, true},
+		{"other method", Filter{Method: "GET"}, false},
+		{"path substring", Filter{Path: "/users"}, true},
+		{"other path", Filter{Path: "/v2"}, false},
+		{"status", Filter{StatusCode: 201}, true},
+		{"other status", Filter{StatusCode: 200}, false},
+		{"content type", Filter{ContentType: "json"}, true},
+		{"other content type", Filter{ContentType: "html"}, false},
+		{"in range", Filter{From: now.Add(-time.Second), To: now.Add(time.Second)}, true},
+		{"to is exclusive", Filter{To: now}, false},
+		{"from is inclusive", Filter{From: now}, true},
+	} {
+		if got := tc.filter.Match(rs); got != tc.match {
+			t.Errorf("%s: got %v", tc.name, got)
+		}
+	}
+
+	if (&Filter{StatusCode: 200}).Match(&RequestSave{}) {
+		t.Error("status filter matches a record without response")
+	}
+}
+
+func TestParseListOptions(t *testing.T) {
+	opts, err := parseListOptions(url.Values{})
+	if err != nil || opts.Limit != defaultListLimit || opts.Offset != 0 || opts.Oldest {
+		t.Errorf("defaults: %+v, %v", opts, err)
+	}
+
+	opts, err = parseListOptions(url.Values{
+		"offset": {"10"},
+		"limit":  {"20"},
+		"sort":   {"time"},
+		"host":   {"example.com"},
+		"status": {"404"},
+		"from":   {"2020-01-02T03:04:05Z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if opts.Offset != 10 || opts.Limit != 20 || !opts.Oldest ||
+		opts.Filter.Host != "example.com" || opts.Filter.StatusCode != 404 || !opts.Filter.From.Equal(from) {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	for _, bad := range []url.Values{
+		{"offset": {"-1"}},
+		{"limit": {"0"}},
+		{"limit": {"1001"}},
+		{"sort": {"host"}},
+		{"status": {"ok"}},
+		{"from": {"yesterday"}},
+		{"to": {"2020-01-02"}},
+	} {
+		if _, err := parseListOptions(bad); err == nil {
+			t.Errorf("%v: no error", bad)
+		}
+	}
+}
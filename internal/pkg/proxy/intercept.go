@@ -0,0 +1,497 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ActionForward = "forward"
+	ActionDrop    = "drop"
+
+	defaultInterceptTimeout = time.Minute
+)
+
+// InterceptRule matches requests by host glob, path regexp and method.
+// Empty fields match everything.
+type InterceptRule struct {
+	Host   string `yaml:"host" json:"host"`
+	Path   string `yaml:"path" json:"path"`
+	Method string `yaml:"method" json:"method"`
+
+	m hostPathMatcher
+}
+
+func (r *InterceptRule) compile() error {
+	var err error
+	r.m, err = newHostPathMatcher(r.Host, r.Path)
+
+	return err
+}
+
+func (r *InterceptRule) Match(rs *RequestSave) bool {
+	if !r.m.matchHost(Hostname(rs.Host)) {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(r.Method, rs.Method) {
+		return false
+	}
+	if r.m.hasPath() && (rs.URL == nil || !r.m.matchPath(rs.URL.Path)) {
+		return false
+	}
+
+	return true
+}
+
+// InterceptSettings turn interception on. With no rules every request is
+// held, timeout is how long a request waits before it is forwarded as is.
+// Responses are held the same way by ResponseEnabled and ResponseRules.
+type InterceptSettings struct {
+	Enabled         bool            `json:"enabled"`
+	Timeout         time.Duration   `json:"timeout"`
+	Rules           []InterceptRule `json:"rules"`
+	ResponseEnabled bool            `json:"response_enabled"`
+	ResponseRules   []InterceptRule `json:"response_rules"`
+}
+
+type plainInterceptSettings InterceptSettings
+
+// MarshalJSON writes Timeout as a duration string like "1m30s".
+func (s InterceptSettings) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		plainInterceptSettings
+		Timeout string `json:"timeout"`
+	}{plainInterceptSettings(s), s.Timeout.String()})
+}
+
+// UnmarshalJSON reads Timeout as a duration string or a number of seconds.
+func (s *InterceptSettings) UnmarshalJSON(b []byte) error {
+	v := struct {
+		*plainInterceptSettings
+		Timeout json.RawMessage `json:"timeout"`
+	}{plainInterceptSettings: (*plainInterceptSettings)(s)}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	s.Timeout = 0
+	if len(v.Timeout) == 0 || string(v.Timeout) == "null" {
+		return nil
+	}
+	var str string
+	if json.Unmarshal(v.Timeout, &str) == nil {
+		s.Timeout, err = time.ParseDuration(str)
+		return errors.Wrap(err, "bad timeout")
+	}
+	var seconds float64
+	if err = json.Unmarshal(v.Timeout, &seconds); err != nil {
+		return errors.New("timeout must be a duration like 1m30s or seconds")
+	}
+	s.Timeout = time.Duration(seconds * float64(time.Second))
+
+	return nil
+}
+
+// InterceptDecision is what an operator does with a held request or
+// response. Override is applied to a forwarded request, Response to a
+// forwarded response.
+type InterceptDecision struct {
+	Action   string            `json:"action"`
+	Override *BurstOverride    `json:"override,omitempty"`
+	Response *ResponseOverride `json:"response,omitempty"`
+}
+
+// ResponseOverride describes changes of a held response. Zero fields keep
+// the upstream values.
+type ResponseOverride struct {
+	StatusCode    int         `json:"status_code"`
+	SetHeaders    http.Header `json:"set_headers"`
+	AddHeaders    http.Header `json:"add_headers"`
+	RemoveHeaders []string    `json:"remove_headers"`
+	Body          *string     `json:"body"`
+	BodyBase64    []byte      `json:"body_base64"`
+}
+
+// PendingRequest is a held request, or a held response to it when
+// Response is set.
+type PendingRequest struct {
+	Request  *RequestSave  `json:"request"`
+	Response *ResponseSave `json:"response,omitempty"`
+	Held     time.Time     `json:"held"`
+
+	decision chan InterceptDecision
+}
+
+// An Interceptor holds requests matching its rules until an operator
+// decides what to do with them or the timeout forwards them as is.
+type Interceptor struct {
+	mu       sync.Mutex
+	settings InterceptSettings
+	pending  map[string]*PendingRequest
+}
+
+func NewInterceptor(settings InterceptSettings) (*Interceptor, error) {
+	i := &Interceptor{pending: make(map[string]*PendingRequest)}
+	err := i.SetSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return i, nil
+}
+
+func (i *Interceptor) Settings() InterceptSettings {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.settings
+}
+
+func (i *Interceptor) SetSettings(settings InterceptSettings) error {
+	var err error
+	settings.Rules, err = compileRules(settings.Rules)
+	if err != nil {
+		return err
+	}
+	settings.ResponseRules, err = compileRules(settings.ResponseRules)
+	if err != nil {
+		return err
+	}
+	if settings.Timeout <= 0 {
+		settings.Timeout = defaultInterceptTimeout
+	}
+
+	i.mu.Lock()
+	i.settings = settings
+	i.mu.Unlock()
+
+	return nil
+}
+
+func compileRules(rules []InterceptRule) ([]InterceptRule, error) {
+	res := make([]InterceptRule, len(rules))
+	copy(res, rules)
+	for j := range res {
+		if err := res[j].compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+func matchRules(rules []InterceptRule, rs *RequestSave) bool {
+	for j := range rules {
+		if rules[j].Match(rs) {
+			return true
+		}
+	}
+
+	return len(rules) == 0
+}
+
+// Match reports whether rs must be held.
+func (i *Interceptor) Match(rs *RequestSave) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.settings.Enabled && matchRules(i.settings.Rules, rs)
+}
+
+// MatchResponse reports whether the response to rs must be held.
+func (i *Interceptor) MatchResponse(rs *RequestSave) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.settings.ResponseEnabled && matchRules(i.settings.ResponseRules, rs)
+}
+
+// Hold blocks until the request is decided on, the timeout forwards it or
+// done is closed, which drops it.
+func (i *Interceptor) Hold(rs *RequestSave, done <-chan struct{}) InterceptDecision {
+	return i.hold(&PendingRequest{Request: rs}, done)
+}
+
+// HoldResponse is Hold for the response to rs.
+func (i *Interceptor) HoldResponse(rs *RequestSave, resp *ResponseSave, done <-chan struct{}) InterceptDecision {
+	return i.hold(&PendingRequest{Request: rs, Response: resp}, done)
+}
+
+func (i *Interceptor) hold(p *PendingRequest, done <-chan struct{}) InterceptDecision {
+	p.Held = time.Now()
+	p.decision = make(chan InterceptDecision, 1)
+	id := p.Request.ID.Hex()
+
+	i.mu.Lock()
+	timeout := i.settings.Timeout
+	i.pending[id] = p
+	i.mu.Unlock()
+
+	defer func() {
+		i.mu.Lock()
+		delete(i.pending, id)
+		i.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case d := <-p.decision:
+		return d
+	case <-timer.C:
+		return InterceptDecision{Action: ActionForward}
+	case <-done:
+		return InterceptDecision{Action: ActionDrop}
+	}
+}
+
+// Pending returns held requests, oldest first.
+func (i *Interceptor) Pending() []*PendingRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	res := make([]*PendingRequest, 0, len(i.pending))
+	for _, p := range i.pending {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Held.Before(res[b].Held)
+	})
+
+	return res
+}
+
+// Decide releases the held request with id.
+func (i *Interceptor) Decide(id string, d InterceptDecision) error {
+	if d.Action != ActionForward && d.Action != ActionDrop {
+		return errors.Errorf("action must be either %s or %s", ActionForward, ActionDrop)
+	}
+
+	i.mu.Lock()
+	p, ok := i.pending[id]
+	if ok && d.Override != nil && p.Response == nil {
+		if err := checkOverrideScheme(p.Request, d.Override); err != nil {
+			i.mu.Unlock()
+			return err
+		}
+	}
+	if ok {
+		delete(i.pending, id)
+	}
+	i.mu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+
+	p.decision <- d
+	return nil
+}
+
+// checkOverrideScheme rejects overrides changing the scheme of a held
+// request. It was received on a plain or a TLS connection, which decides
+// how it goes upstream, so the change couldn't be applied.
+func checkOverrideScheme(rs *RequestSave, o *BurstOverride) error {
+	if o.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(o.URL)
+	if err != nil {
+		return errors.Wrap(err, "can't parse url")
+	}
+	if scheme := rs.TargetURL().Scheme; !strings.EqualFold(u.Scheme, scheme) {
+		return errors.Errorf("scheme of a held request can't be changed from %s", scheme)
+	}
+
+	return nil
+}
+
+// ApplyOverride changes req and its record rs in place as described by o.
+// The scheme can't be changed, see checkOverrideScheme.
+func ApplyOverride(req *http.Request, rs *RequestSave, o *BurstOverride) error {
+	if err := checkOverrideScheme(rs, o); err != nil {
+		return err
+	}
+	changed, err := o.Apply(rs)
+	if err != nil {
+		return err
+	}
+	changed.ID = rs.ID
+	changed.ParentID = rs.ParentID
+	changed.Time = rs.Time
+	changed.RequestURI = rs.RequestURI
+	*rs = *changed
+
+	target := rs.TargetURL()
+	req.Method = rs.Method
+	req.Host = rs.Host
+	req.URL.Host = target.Host
+	req.URL.Path = target.Path
+	req.URL.RawPath = target.RawPath
+	req.URL.RawQuery = target.RawQuery
+	req.Header = cloneHeader(rs.Header)
+	if !rs.Truncated {
+		// a truncated body isn't changed, so the received one is sent on
+		req.Body = ioutil.NopCloser(bytes.NewReader(rs.Body))
+		req.ContentLength = int64(len(rs.Body))
+		req.TransferEncoding = rs.TransferEncoding
+	}
+
+	return nil
+}
+
+// GetModifyResponse returns httputil.ReverseProxy response hook which holds
+// responses matching the response rules. The record of the request must be
+// in the request context, see WithRequestSave. Gzip and deflate bodies are
+// held and sent on decoded.
+func GetModifyResponse(i *Interceptor, log *logrus.Logger) func(resp *http.Response) error {
+	return func(resp *http.Response) error {
+		ctx := resp.Request.Context()
+		rs := RequestSaveFromContext(ctx)
+		if i == nil || rs == nil || !i.MatchResponse(rs) {
+			return nil
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrap(err, "can't read response body")
+		}
+		// edits are made to the decoded body, which is sent decoded
+		body, decoded, err := decodeBody(resp.Header, body)
+		if err != nil {
+			return err
+		}
+		held := &ResponseSave{
+			StatusCode: resp.StatusCode,
+			Header:     cloneHeader(resp.Header),
+			Body:       body,
+		}
+
+		log.WithField("id", rs.ID.Hex()).Info("response intercepted")
+		d := i.HoldResponse(rs, held, ctx.Done())
+		if d.Action == ActionDrop {
+			return errors.New("response dropped by proxy")
+		}
+
+		if o := d.Response; o != nil {
+			if o.StatusCode != 0 {
+				resp.StatusCode = o.StatusCode
+				resp.Status = fmt.Sprintf("%d %s", o.StatusCode, http.StatusText(o.StatusCode))
+			}
+			for k, v := range o.SetHeaders {
+				resp.Header[http.CanonicalHeaderKey(k)] = v
+			}
+			for k, v := range o.AddHeaders {
+				for _, vv := range v {
+					resp.Header.Add(k, vv)
+				}
+			}
+			for _, k := range o.RemoveHeaders {
+				resp.Header.Del(k)
+			}
+			switch {
+			case o.BodyBase64 != nil:
+				body = o.BodyBase64
+			case o.Body != nil:
+				body = []byte(*o.Body)
+			}
+			if !decoded && (o.BodyBase64 != nil || o.Body != nil) {
+				// a new body can't be in an encoding we can't make
+				resp.Header.Del("Content-Encoding")
+			}
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		resp.Header.Del("Transfer-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+		return nil
+	}
+}
+
+// GetInterceptHandler returns handler for GET /intercept, which lists the
+// settings and held requests.
+func GetInterceptHandler(i *Interceptor) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		OkResponse(res, map[string]interface{}{
+			"settings": i.Settings(),
+			"pending":  i.Pending(),
+		})
+	}
+}
+
+// GetInterceptSettingsHandler returns handler for PUT /intercept, which
+// replaces the settings with InterceptSettings from the body.
+func GetInterceptSettingsHandler(i *Interceptor) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+
+		settings := InterceptSettings{}
+		err := json.NewDecoder(req.Body).Decode(&settings)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse settings")
+
+			log.WithError(err).Error("can't parse settings")
+			return
+		}
+
+		err = i.SetSettings(settings)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("can't set settings")
+			return
+		}
+		OkResponse(res, i.Settings())
+	}
+}
+
+// GetInterceptDecisionHandler returns handler for POST /intercept/{id},
+// which takes InterceptDecision from the body.
+func GetInterceptDecisionHandler(i *Interceptor) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		id := mux.Vars(req)["id"]
+
+		d := InterceptDecision{}
+		err := json.NewDecoder(req.Body).Decode(&d)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse decision")
+
+			log.WithError(err).Error("can't parse decision")
+			return
+		}
+
+		err = i.Decide(id, d)
+		if err == ErrNotFound {
+			ErrResponse(res, http.StatusNotFound, "no pending request")
+
+			log.WithField("id", id).Error("no pending request")
+			return
+		}
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("can't decide")
+			return
+		}
+		OkResponse(res, d)
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func heldRequest() *RequestSave {
+	return &RequestSave{
+		ID:     bson.NewObjectId(),
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/"},
+		Host:   "example.com",
+		Header: http.Header{},
+	}
+}
+
+// waitPending waits until n requests are held.
+func waitPending(t *testing.T, i *Interceptor, n int) []*PendingRequest {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		if p := i.Pending(); len(p) == n {
+			return p
+		}
+	}
+	t.Fatalf("%d requests aren't held", n)
+
+	return nil
+}
+
+func TestInterceptorDecisions(t *testing.T) {
+	i, err := NewInterceptor(InterceptSettings{Enabled: true, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	requests := make([]*RequestSave, n)
+	decisions := make([]InterceptDecision, n)
+	wg := sync.WaitGroup{}
+	for j := range requests {
+		requests[j] = heldRequest()
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			decisions[j] = i.Hold(requests[j], nil)
+		}(j)
+	}
+	waitPending(t, i, n)
+
+	for j, rs := range requests {
+		action := ActionForward
+		if j%2 == 1 {
+			action = ActionDrop
+		}
+		if err := i.Decide(rs.ID.Hex(), InterceptDecision{Action: action}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	for j, d := range decisions {
+		if want := []string{ActionForward, ActionDrop}[j%2]; d.Action != want {
+			t.Errorf("request %d: %s, want %s", j, d.Action, want)
+		}
+	}
+	if len(i.Pending()) != 0 {
+		t.Error("decided requests are still held")
+	}
+	if err := i.Decide(requests[0].ID.Hex(), InterceptDecision{Action: ActionForward}); err != ErrNotFound {
+		t.Errorf("decided twice: %v", err)
+	}
+}
+
+func TestInterceptorTimeoutAndDone(t *testing.T) {
+	i, err := NewInterceptor(InterceptSettings{Enabled: true, Timeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := i.Hold(heldRequest(), nil); d.Action != ActionForward {
+		t.Errorf("timed out request: %s", d.Action)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if d := i.Hold(heldRequest(), done); d.Action != ActionDrop {
+		t.Errorf("request of a gone client: %s", d.Action)
+	}
+}
+
+func TestInterceptorRejectsScheme(t *testing.T) {
+	i, err := NewInterceptor(InterceptSettings{Enabled: true, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := heldRequest()
+	result := make(chan InterceptDecision)
+	go func() {
+		result <- i.Hold(rs, nil)
+	}()
+	waitPending(t, i, 1)
+
+	err = i.Decide(rs.ID.Hex(), InterceptDecision{
+		Action:   ActionForward,
+		Override: &BurstOverride{URL: "http://example.com/"},
+	})
+	if err == nil {
+		t.Fatal("scheme change accepted")
+	}
+
+	override := &BurstOverride{URL: "https://example.com/other"}
+	err = i.Decide(rs.ID.Hex(), InterceptDecision{Action: ActionForward, Override: override})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := <-result
+
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	if err := ApplyOverride(req, rs, d.Override); err != nil {
+		t.Fatal(err)
+	}
+	if req.URL.Path != "/other" || rs.URL.Path != "/other" {
+		t.Errorf("override not applied: %s", req.URL)
+	}
+}
+
+func TestInterceptSettingsJSON(t *testing.T) {
+	for raw, want := range map[string]time.Duration{
+		`{"timeout": "1m30s"}`: 90 * time.Second,
+		`{"timeout": 2.5}`:     2500 * time.Millisecond,
+		`{"timeout": null}`:    0,
+		`{}`:                   0,
+	} {
+		s := InterceptSettings{}
+		if err := json.Unmarshal([]byte(raw), &s); err != nil || s.Timeout != want {
+			t.Errorf("%s: %v, %v", raw, s.Timeout, err)
+		}
+	}
+
+	s := InterceptSettings{}
+	if err := json.Unmarshal([]byte(`{"timeout": "soon"}`), &s); err == nil {
+		t.Error("bad timeout accepted")
+	}
+
+	b, err := json.Marshal(InterceptSettings{Enabled: true, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = InterceptSettings{}
+	if err := json.Unmarshal(b, &s); err != nil || !s.Enabled || s.Timeout != time.Minute {
+		t.Errorf("%s: %+v, %v", b, s, err)
+	}
+}
+
+func heldResponse(t *testing.T, i *Interceptor, header http.Header, body []byte, d InterceptDecision) (*http.Response, *PendingRequest, error) {
+	rs := heldRequest()
+	req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req = req.WithContext(WithRequestSave(req.Context(), rs))
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+
+	var held *PendingRequest
+	go func() {
+		held = waitPending(t, i, 1)[0]
+		if err := i.Decide(rs.ID.Hex(), d); err != nil {
+			t.Error(err)
+		}
+	}()
+	err := GetModifyResponse(i, logrus.New())(resp)
+
+	return resp, held, err
+}
+
+func TestInterceptResponse(t *testing.T) {
+	i, err := NewInterceptor(InterceptSettings{ResponseEnabled: true, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gz := &bytes.Buffer{}
+	zw := gzip.NewWriter(gz)
+	_, _ = zw.Write([]byte("original"))
+	_ = zw.Close()
+
+	edited := "edited"
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		body     []byte
+		d        InterceptDecision
+		held     string
+		want     string
+		encoded  bool
+	}{
+		{"gzip forwarded", "gzip", gz.Bytes(), InterceptDecision{Action: ActionForward}, "original", "original", false},
+		{
+			"gzip edited", "gzip", gz.Bytes(),
+			InterceptDecision{Action: ActionForward, Response: &ResponseOverride{StatusCode: 201, Body: &edited}},
+			"original", "edited", false,
+		},
+		{"unknown encoding forwarded", "br", []byte("\x0b\x03"), InterceptDecision{Action: ActionForward}, "\x0b\x03", "\x0b\x03", true},
+		{
+			"unknown encoding edited", "br", []byte("\x0b\x03"),
+			InterceptDecision{Action: ActionForward, Response: &ResponseOverride{Body: &edited}},
+			"\x0b\x03", "edited", false,
+		},
+	} {
+		header := http.Header{"Content-Encoding": {tc.encoding}, "Content-Length": {strconv.Itoa(len(tc.body))}}
+		resp, held, err := heldResponse(t, i, header, tc.body, tc.d)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if string(held.Response.Body) != tc.held {
+			t.Errorf("%s: held %q", tc.name, held.Response.Body)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != tc.want || resp.Header.Get("Content-Length") != strconv.Itoa(len(tc.want)) ||
+			resp.ContentLength != int64(len(tc.want)) {
+			t.Errorf("%s: got %q, length %s", tc.name, body, resp.Header.Get("Content-Length"))
+		}
+		if encoded := resp.Header.Get("Content-Encoding") != ""; encoded != tc.encoded {
+			t.Errorf("%s: content encoding %q", tc.name, resp.Header.Get("Content-Encoding"))
+		}
+		if tc.d.Response != nil && tc.d.Response.StatusCode != 0 && resp.StatusCode != tc.d.Response.StatusCode {
+			t.Errorf("%s: status %d", tc.name, resp.StatusCode)
+		}
+	}
+
+	_, _, err = heldResponse(t, i, http.Header{}, []byte("x"), InterceptDecision{Action: ActionDrop})
+	if err == nil {
+		t.Error("dropped response was sent")
+	}
+}
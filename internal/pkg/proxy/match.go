@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// A hostPathMatcher matches a host glob and a path regexp of the scope and
+// intercept rules. Empty ones match everything.
+type hostPathMatcher struct {
+	host string
+	path *regexp.Regexp
+}
+
+func newHostPathMatcher(host, pathRe string) (hostPathMatcher, error) {
+	m := hostPathMatcher{host: host}
+	if err := checkHostGlob(host); err != nil {
+		return m, err
+	}
+	if pathRe != "" {
+		re, err := regexp.Compile(pathRe)
+		if err != nil {
+			return m, errors.Wrapf(err, "bad path regexp %q", pathRe)
+		}
+		m.path = re
+	}
+
+	return m, nil
+}
+
+func (m *hostPathMatcher) matchHost(host string) bool {
+	return m.host == "" || matchHostGlob(m.host, host)
+}
+
+func (m *hostPathMatcher) hasPath() bool {
+	return m.path != nil
+}
+
+func (m *hostPathMatcher) matchPath(p string) bool {
+	return m.path == nil || m.path.MatchString(p)
+}
+
+// checkHostGlob reports a malformed host glob, which path.Match would
+// only fail on when it is used.
+func checkHostGlob(glob string) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return errors.Wrapf(err, "bad host glob %q", glob)
+	}
+
+	return nil
+}
+
+// matchHostGlob matches host against glob ignoring case.
+func matchHostGlob(glob, host string) bool {
+	ok, _ := path.Match(strings.ToLower(glob), strings.ToLower(host))
+	return ok
+}
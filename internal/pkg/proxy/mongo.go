@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoStore implements Store on top of a mongo collection. WebSocket
+// frames are kept in the collection with "_frames" appended to its name.
+type MongoStore struct {
+	collection *mgo.Collection
+	frames     *mgo.Collection
+}
+
+func NewMongoStore(collection *mgo.Collection) *MongoStore {
+	return &MongoStore{
+		collection: collection,
+		frames:     collection.Database.C(collection.Name + "_frames"),
+	}
+}
+
+func (s *MongoStore) Save(rs *RequestSave) (string, error) {
+	if rs.ID == "" {
+		rs.ID = bson.NewObjectId()
+	}
+
+	_, err := s.collection.UpsertId(rs.ID, rs)
+	if err != nil {
+		return "", errors.Wrap(err, "can't upsert request")
+	}
+
+	return rs.ID.Hex(), nil
+}
+
+func (s *MongoStore) Get(id string) (*RequestSave, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrNotFound
+	}
+
+	rs := &RequestSave{}
+	err := s.collection.FindId(bson.ObjectIdHex(id)).One(rs)
+	if err == mgo.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can't find request")
+	}
+
+	return rs, nil
+}
+
+func (s *MongoStore) List(opts ListOptions) ([]*RequestSave, error) {
+	sort := []string{"-time", "-_id"}
+	if opts.Oldest {
+		sort = []string{"time", "_id"}
+	}
+
+	query := s.collection.Find(mongoFilter(&opts.Filter)).Sort(sort...).Skip(opts.Offset)
+	if opts.Limit > 0 {
+		query = query.Limit(opts.Limit)
+	}
+
+	res := make([]*RequestSave, 0)
+	err := query.All(&res)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list requests")
+	}
+
+	return res, nil
+}
+
+func (s *MongoStore) Delete(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFound
+	}
+
+	err := s.collection.RemoveId(bson.ObjectIdHex(id))
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return errors.Wrap(err, "can't remove request")
+	}
+
+	_, err = s.frames.RemoveAll(bson.M{"connection_id": bson.ObjectIdHex(id)})
+	if err != nil {
+		return errors.Wrap(err, "can't remove frames")
+	}
+
+	return nil
+}
+
+func (s *MongoStore) SaveFrame(f *WebSocketFrame) error {
+	if f.ID == "" {
+		f.ID = bson.NewObjectId()
+	}
+
+	err := s.frames.Insert(f)
+	if err != nil {
+		return errors.Wrap(err, "can't insert frame")
+	}
+
+	return nil
+}
+
+func (s *MongoStore) Frames(connectionID string, offset, limit int) ([]*WebSocketFrame, error) {
+	res := make([]*WebSocketFrame, 0)
+	if !bson.IsObjectIdHex(connectionID) {
+		return res, nil
+	}
+
+	query := s.frames.Find(bson.M{"connection_id": bson.ObjectIdHex(connectionID)}).Sort("_id").Skip(offset)
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.All(&res)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list frames")
+	}
+
+	return res, nil
+}
+
+func (s *MongoStore) Close() error {
+	s.collection.Database.Session.Close()
+
+	return nil
+}
+
+func mongoFilter(f *Filter) bson.M {
+	q := bson.M{}
+	if f.Host != "" {
+		q["host"] = bson.RegEx{Pattern: "^" + regexp.QuoteMeta(f.Host) + "(:[0-9]+)?$", Options: "i"}
+	}
+	if f.Method != "" {
+		q["method"] = strings.ToUpper(f.Method)
+	}
+	if f.Path != "" {
+		q["url.path"] = bson.RegEx{Pattern: regexp.QuoteMeta(f.Path)}
+	}
+	if f.StatusCode != 0 {
+		q["response.status_code"] = f.StatusCode
+	}
+	if f.ContentType != "" {
+		q["response.header.Content-Type"] = bson.RegEx{Pattern: regexp.QuoteMeta(f.ContentType)}
+	}
+
+	timeRange := bson.M{}
+	if !f.From.IsZero() {
+		timeRange["$gte"] = f.From
+	}
+	if !f.To.IsZero() {
+		timeRange["$lt"] = f.To
+	}
+	if len(timeRange) != 0 {
+		q["time"] = timeRange
+	}
+
+	return q
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+)
+
+type pacRule struct {
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Scheme string `json:"scheme"`
+	Path   bool   `json:"path"`
+}
+
+func pacRules(rules []ScopeRule) []pacRule {
+	res := make([]pacRule, 0, len(rules))
+	for _, r := range rules {
+		res = append(res, pacRule{
+			Host:   strings.ToLower(r.Host),
+			Port:   r.Port,
+			Scheme: strings.ToLower(r.Scheme),
+			Path:   r.Path != "",
+		})
+	}
+
+	return res
+}
+
+var pacTemplate = template.Must(template.New("pac").Parse(`function FindProxyForURL(url, host) {
+	var proxy = {{.Proxy}};
+	var extra = {{.Extra}};
+	var include = {{.Include}};
+	var exclude = {{.Exclude}};
+
+	host = host.toLowerCase();
+	var scheme = url.substring(0, url.indexOf(":")).toLowerCase();
+	var m = url.match(/^[a-z]+:\/\/[^\/]*:(\d+)/i);
+	var port = m ? parseInt(m[1], 10) : (scheme == "https" ? 443 : 80);
+
+	function match(r) {
+		return (!r.host || shExpMatch(host, r.host)) &&
+			(!r.port || r.port == port) &&
+			(!r.scheme || r.scheme == scheme);
+	}
+
+	for (var i = 0; i < extra.length; i++) {
+		if (host == extra[i]) {
+			return proxy;
+		}
+	}
+	if (scheme != "http" && scheme != "https") {
+		return "DIRECT";
+	}
+	var included = include.length == 0;
+	for (var i = 0; i < include.length; i++) {
+		if (match(include[i])) {
+			included = true;
+			break;
+		}
+	}
+	if (!included) {
+		return "DIRECT";
+	}
+	for (var i = 0; i < exclude.length; i++) {
+		if (!exclude[i].path && match(exclude[i])) {
+			return "DIRECT";
+		}
+	}
+
+	return proxy;
+}
+`))
+
+// PAC renders a proxy auto-config script sending in-scope urls to the
+// proxy at addr, reached over TLS when secure. Browsers don't show paths
+// of https urls to PAC scripts, so path rules are ignored like in InScope
+// for urls without path. Hosts in extra always go through the proxy.
+func PAC(settings ScopeSettings, addr string, secure bool, extra ...string) ([]byte, error) {
+	hosts := make([]string, 0, len(extra))
+	for _, h := range extra {
+		hosts = append(hosts, strings.ToLower(h))
+	}
+
+	proxy := "PROXY " + addr
+	if secure {
+		proxy = "HTTPS " + addr
+	}
+
+	data := map[string]string{}
+	for name, v := range map[string]interface{}{
+		"Proxy":   proxy,
+		"Extra":   hosts,
+		"Include": pacRules(settings.Include),
+		"Exclude": pacRules(settings.Exclude),
+	} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		data[name] = string(b)
+	}
+
+	buf := &bytes.Buffer{}
+	err := pacTemplate.Execute(buf, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestPAC(t *testing.T) {
+	pac, err := PAC(ScopeSettings{
+		Include: []ScopeRule{{Host: "*.Example.com", Port: 443}},
+		Exclude: []ScopeRule{{Host: "static.example.com"}, {Path: `\.js$`}},
+	}, "10.0.0.1:8888", false, "proxy.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`var proxy = "PROXY 10.0.0.1:8888";`,
+		`var extra = ["proxy.local"];`,
+		`{"host":"*.example.com","port":443,"scheme":"","path":false}`,
+		`{"host":"","port":0,"scheme":"","path":true}`,
+	} {
+		if !strings.Contains(string(pac), want) {
+			t.Errorf("pac has no %s:\n%s", want, pac)
+		}
+	}
+}
+
+func TestPACSecure(t *testing.T) {
+	pac, err := PAC(ScopeSettings{}, "10.0.0.1:8888", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `var proxy = "HTTPS 10.0.0.1:8888";`; !strings.Contains(string(pac), want) {
+		t.Errorf("pac has no %s:\n%s", want, pac)
+	}
+}
+
+// shExpMatch is the PAC helper browsers provide, matching a shell glob.
+const shExpMatch = `function shExpMatch(str, exp) {
+	var re = exp.replace(/[.+^${}()|[\]\\]/g, "\\$&").replace(/\*/g, ".*").replace(/\?/g, ".");
+	return new RegExp("^" + re + "$").test(str);
+}
+`
+
+func TestPACFindProxyForURL(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("no node")
+	}
+
+	pac, err := PAC(ScopeSettings{
+		Include: []ScopeRule{{Host: "*.Example.com"}, {Host: "api.test", Scheme: "https"}},
+		Exclude: []ScopeRule{{Host: "static.example.com"}, {Host: "*.example.com", Port: 8080}, {Path: `\.js$`}},
+	}, "10.0.0.1:8888", false, "proxy.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url  string
+		want string
+	}{
+		{"http://www.example.com/", "PROXY 10.0.0.1:8888"},
+		{"https://WWW.EXAMPLE.COM/app.js", "PROXY 10.0.0.1:8888"},
+		{"http://www.example.com:8080/", "DIRECT"},
+		{"http://static.example.com/", "DIRECT"},
+		{"http://example.com/", "DIRECT"},
+		{"https://api.test/", "PROXY 10.0.0.1:8888"},
+		{"http://api.test/", "DIRECT"},
+		{"ftp://www.example.com/", "DIRECT"},
+		{"http://proxy.local/", "PROXY 10.0.0.1:8888"},
+	}
+	script := &strings.Builder{}
+	script.Write(pac)
+	script.WriteString(shExpMatch)
+	script.WriteString("var res = [];\n")
+	for _, c := range cases {
+		u, _ := json.Marshal(c.url)
+		script.WriteString("res.push(FindProxyForURL(" + string(u) + ", " + string(u) + ".split(\"/\")[2].split(\":\")[0]));\n")
+	}
+	script.WriteString("console.log(JSON.stringify(res));\n")
+
+	out, err := exec.Command(node, "-e", script.String()).Output()
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, script)
+	}
+	var got []string
+	if err = json.Unmarshal(out, &got); err != nil || len(got) != len(cases) {
+		t.Fatalf("%q: %v", out, err)
+	}
+	for i, c := range cases {
+		if got[i] != c.want {
+			t.Errorf("%s: got %s, want %s", c.url, got[i], c.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"bufio"
+	"container/list"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	tunnelDialTimeout = 30 * time.Second
+	// maxFailedHosts bounds the hosts tunneled automatically, the oldest
+	// ones are decrypted again.
+	maxFailedHosts = 1024
+)
+
+// certRejectedAlerts are the TLS alerts of a client which doesn't trust the
+// certificate, as their text appears in the handshake error.
+var certRejectedAlerts = []string{
+	"bad certificate",
+	"unsupported certificate",
+	"revoked certificate",
+	"expired certificate",
+	"unknown certificate",
+	"unknown certificate authority",
+}
+
+// Passthrough decides which CONNECT hosts are tunneled as is instead of
+// being decrypted. With auto enabled, hosts whose clients refused the
+// generated certificate are tunneled from then on.
+type Passthrough struct {
+	hosts []string
+	auto  bool
+
+	mu     sync.RWMutex
+	failed map[string]*list.Element
+	order  *list.List
+}
+
+func NewPassthrough(hosts []string, auto bool) (*Passthrough, error) {
+	for _, h := range hosts {
+		if err := checkHostGlob(h); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Passthrough{
+		hosts:  hosts,
+		auto:   auto,
+		failed: make(map[string]*list.Element),
+		order:  list.New(),
+	}, nil
+}
+
+// Match reports whether connections to host must be tunneled.
+func (p *Passthrough) Match(host string) bool {
+	if p == nil {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	for _, h := range p.hosts {
+		if matchHostGlob(h, host) {
+			return true
+		}
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, ok := p.failed[host]
+
+	return ok
+}
+
+// HandshakeFailed remembers host when err shows that the client refused
+// its certificate. Other failures, like a client going away, are ignored.
+func (p *Passthrough) HandshakeFailed(host string, err error) {
+	if p == nil || !p.auto || !CertificateRejected(err) {
+		return
+	}
+
+	host = strings.ToLower(host)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.failed[host]; ok {
+		return
+	}
+	p.failed[host] = p.order.PushBack(host)
+	if p.order.Len() > maxFailedHosts {
+		oldest := p.order.Front()
+		p.order.Remove(oldest)
+		delete(p.failed, oldest.Value.(string))
+	}
+}
+
+// CertificateRejected reports whether err is a TLS alert of a client which
+// doesn't accept the server certificate.
+func CertificateRejected(err error) bool {
+	// crypto/tls wraps the alert, so it is unwrapped by hand.
+	err = errors.Cause(err)
+	for err != nil {
+		if opErr, ok := err.(*net.OpError); ok {
+			return opErr.Op == "remote error" && opErr.Err != nil && certRejectedAlert(opErr.Err)
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return false
+		}
+		err = u.Unwrap()
+	}
+
+	return false
+}
+
+func certRejectedAlert(alert error) bool {
+	text := strings.TrimPrefix(alert.Error(), "tls: ")
+	for _, a := range certRejectedAlerts {
+		if text == a {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DialTunnel connects to the tunnel upstream. It is done before the client
+// is told that the tunnel is established, so a failure can be answered.
+func DialTunnel(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, tunnelDialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't dial tunnel upstream")
+	}
+
+	return conn, nil
+}
+
+// Tunnel copies bytes between the hijacked client connection and upstream,
+// dialed with DialTunnel to addr, until either side closes. Bytes already
+// buffered from the client are sent first.
+func Tunnel(client net.Conn, buffered *bufio.Reader, upstream net.Conn, addr string, log *logrus.Logger) {
+	defer client.Close()
+	defer upstream.Close()
+
+	var sent int64
+	done := make(chan struct{})
+	go func() {
+		var src io.Reader = client
+		if buffered != nil {
+			src = buffered
+		}
+		sent, _ = io.Copy(upstream, src)
+		closeWrite(upstream)
+		close(done)
+	}()
+
+	received, _ := io.Copy(client, upstream)
+	closeWrite(client)
+	<-done
+
+	log.WithFields(logrus.Fields{
+		"host":     addr,
+		"sent":     sent,
+		"received": received,
+	}).Info("tunnel closed")
+}
+
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// serverHandshake returns the error of the server side of a TLS handshake
+// with client.
+func serverHandshake(t *testing.T, client func(net.Conn)) error {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	cert := srv.TLS.Certificates[0]
+	srv.Close()
+
+	c, s := net.Pipe()
+	go func() {
+		client(c)
+		c.Close()
+	}()
+	defer s.Close()
+
+	return tls.Server(s, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+}
+
+func TestCertificateRejected(t *testing.T) {
+	err := serverHandshake(t, func(c net.Conn) {
+		_ = tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake()
+	})
+	if !CertificateRejected(err) || !CertificateRejected(errors.Wrap(err, "handshake")) {
+		t.Errorf("untrusted certificate: %v", err)
+	}
+
+	err = serverHandshake(t, func(c net.Conn) {
+		_, _ = c.Write([]byte{0x16, 3, 1})
+	})
+	if err == nil || CertificateRejected(err) {
+		t.Errorf("client gone: %v", err)
+	}
+	if CertificateRejected(nil) {
+		t.Error("no error")
+	}
+}
+
+func TestPassthroughHandshakeFailed(t *testing.T) {
+	rejected := serverHandshake(t, func(c net.Conn) {
+		_ = tls.Client(c, &tls.Config{ServerName: "example.com"}).Handshake()
+	})
+
+	p, err := NewPassthrough([]string{"*.bank.com"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Match("www.Bank.com") || p.Match("bank.com") {
+		t.Error("host globs don't match")
+	}
+
+	p.HandshakeFailed("pinned.com", io.EOF)
+	if p.Match("pinned.com") {
+		t.Error("host tunneled after eof")
+	}
+	p.HandshakeFailed("Pinned.com", rejected)
+	if !p.Match("pinned.com") {
+		t.Error("host isn't tunneled after rejection")
+	}
+
+	for i := 0; i < maxFailedHosts; i++ {
+		p.HandshakeFailed(strconv.Itoa(i)+".com", rejected)
+	}
+	if p.Match("pinned.com") || !p.Match("0.com") || len(p.failed) != maxFailedHosts || p.order.Len() != maxFailedHosts {
+		t.Errorf("%d hosts kept", len(p.failed))
+	}
+
+	manual, err := NewPassthrough(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manual.HandshakeFailed("pinned.com", rejected)
+	if manual.Match("pinned.com") {
+		t.Error("host tunneled without auto")
+	}
+
+	if _, err = NewPassthrough([]string{"["}, false); err == nil {
+		t.Error("bad host glob accepted")
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	upstream, err := DialTunnel(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, proxied := net.Pipe()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	go Tunnel(proxied, nil, upstream, ln.Addr().String(), log)
+
+	go func() {
+		_, _ = client.Write([]byte("ping"))
+	}()
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("got %q, %v", buf, err)
+	}
+	client.Close()
+
+	ln.Close()
+	if _, err = DialTunnel(ln.Addr().String()); err == nil {
+		t.Error("dialed a closed port")
+	}
+}
@@ -1,12 +1,14 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net/http"
-	"strings"
+	"time"
 
-	"gopkg.in/mgo.v2"
+	"github.com/pkg/errors"
 
 	"github.com/sirupsen/logrus"
 
@@ -20,7 +22,10 @@ func getTraceLogger(ctx context.Context) *logrus.Logger {
 	return log
 }
 
-func GetBurstHandler(client *http.Client, col *mgo.Collection) func(res http.ResponseWriter, req *http.Request) {
+// GetBurstHandler returns handler for POST /burst?id=. A JSON BurstOverride
+// in the body changes the saved request before sending, and the changed
+// request is saved as a new record together with the response.
+func GetBurstHandler(client *http.Client, store Store) func(res http.ResponseWriter, req *http.Request) {
 	return func(res http.ResponseWriter, req *http.Request) {
 		log := getTraceLogger(req.Context())
 		log.WithField("req", req).Info("got")
@@ -28,16 +33,49 @@ func GetBurstHandler(client *http.Client, col *mgo.Collection) func(res http.Res
 		query := req.URL.Query()
 		id := query.Get("id")
 
-		savedReq, err := GetSavedRequest(id, col)
+		saved, err := store.Get(id)
+		if err == ErrNotFound {
+			ErrResponse(res, http.StatusNotFound, "request not found")
+
+			log.WithField("id", id).Error("request not found")
+			return
+		}
 		if err != nil {
 			ErrResponse(res, http.StatusBadRequest, "can't get request")
 
 			log.WithError(err).Error("can't get request")
 			return
 		}
-		savedReq.URL.Host = savedReq.Host
-		savedReq.URL.Scheme = strings.ToLower(strings.Split(savedReq.Proto, "/")[0])
+
+		override, err := readBurstOverride(req)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse override")
+
+			log.WithError(err).Error("can't parse override")
+			return
+		}
+		if override != nil {
+			saved, err = override.Apply(saved)
+			if err != nil {
+				ErrResponse(res, http.StatusBadRequest, err.Error())
+
+				log.WithError(err).Error("can't apply override")
+				return
+			}
+		}
+
+		if saved.Truncated {
+			ErrResponse(res, http.StatusBadRequest, "request body is truncated")
+
+			log.WithField("id", id).Error("request body is truncated")
+			return
+		}
+
+		savedReq := saved.GetHTTPForm()
+		savedReq.URL = saved.TargetURL()
 		savedReq.RequestURI = ""
+
+		started := time.Now()
 		resp, err := client.Do(savedReq)
 		if err != nil {
 			ErrResponse(res, http.StatusInternalServerError, "can't do request")
@@ -46,6 +84,7 @@ func GetBurstHandler(client *http.Client, col *mgo.Collection) func(res http.Res
 			return
 		}
 		defer resp.Body.Close()
+		ttfb := time.Since(started)
 
 		b, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -54,6 +93,46 @@ func GetBurstHandler(client *http.Client, col *mgo.Collection) func(res http.Res
 			log.WithError(err).Error("can't do read response body")
 			return
 		}
+
+		if override != nil {
+			saved.Response = &ResponseSave{
+				StatusCode: resp.StatusCode,
+				Header:     resp.Header,
+				Body:       b,
+				Trailer:    resp.Trailer,
+				TTFB:       ttfb,
+				Duration:   time.Since(started),
+			}
+			newID, saveErr := store.Save(saved)
+			if saveErr != nil {
+				log.WithError(saveErr).Error("can't save modified request")
+			} else {
+				res.Header().Set("ID", newID)
+			}
+		}
+
 		ResponseBinaryObject(res, resp.StatusCode, b)
 	}
 }
+
+func readBurstOverride(req *http.Request) (*BurstOverride, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read body")
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+
+	override := &BurstOverride{}
+	err = json.Unmarshal(b, override)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't unmarshal override")
+	}
+
+	return override, nil
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRecordedBody limits the request and the response body kept in a
+// record, so records with both stay below the 16MB document limit of Mongo.
+// Longer bodies are passed on whole but saved truncated.
+const maxRecordedBody = 7 << 20
+
+type ResponseSave struct {
+	StatusCode int           `bson:"status_code" json:"status_code"`
+	Header     http.Header   `bson:"header" json:"header"`
+	Body       []byte        `bson:"body" json:"body"`
+	Truncated  bool          `bson:"truncated,omitempty" json:"truncated,omitempty"`
+	Trailer    http.Header   `bson:"trailer" json:"trailer"`
+	TTFB       time.Duration `bson:"ttfb" json:"ttfb"`
+	Duration   time.Duration `bson:"duration" json:"duration"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+// A ResponseRecorder implements http.ResponseWriter and keeps a copy of
+// the status, headers and body written through it.
+type ResponseRecorder struct {
+	http.ResponseWriter
+
+	started   time.Time
+	firstByte time.Time
+	status    int
+	header    http.Header
+	body      bytes.Buffer
+	truncated bool
+	err       error
+	hijacked  bool
+}
+
+func NewResponseRecorder(res http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{
+		ResponseWriter: res,
+		started:        time.Now(),
+	}
+}
+
+func (r *ResponseRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.firstByte = time.Now()
+		r.status = code
+		r.header = cloneHeader(r.ResponseWriter.Header())
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	kept := b
+	if room := maxRecordedBody - r.body.Len(); len(kept) > room {
+		kept = kept[:room]
+		r.truncated = true
+	}
+	r.body.Write(kept)
+
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *ResponseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil && r.status == 0 {
+		r.firstByte = time.Now()
+		r.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// SetError remembers the upstream error which caused the response.
+func (r *ResponseRecorder) SetError(err error) {
+	r.err = err
+}
+
+// Response returns everything recorded so far. It must be called after the
+// wrapped handler has returned, so trailers are in place. A connection
+// hijacked for an upgrade is recorded as switching protocols with the
+// headers left in the writer.
+func (r *ResponseRecorder) Response() *ResponseSave {
+	now := time.Now()
+	if r.hijacked {
+		r.status = http.StatusSwitchingProtocols
+		r.header = cloneHeader(r.ResponseWriter.Header())
+	}
+	rs := &ResponseSave{
+		StatusCode: r.status,
+		Header:     r.header,
+		Body:       r.body.Bytes(),
+		Truncated:  r.truncated,
+		Trailer:    http.Header{},
+		Duration:   now.Sub(r.started),
+	}
+	if !r.firstByte.IsZero() {
+		rs.TTFB = r.firstByte.Sub(r.started)
+	}
+	if r.err != nil {
+		rs.Error = r.err.Error()
+	}
+
+	live := r.ResponseWriter.Header()
+	for _, declared := range r.header["Trailer"] {
+		for _, k := range strings.Split(declared, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			if v, ok := live[k]; ok {
+				rs.Trailer[k] = v
+			}
+		}
+	}
+	for k, v := range live {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			rs.Trailer[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = v
+		}
+	}
+
+	return rs
+}
+
+// GetErrorHandler returns httputil.ReverseProxy error handler which stores
+// the upstream error in the recorder, if any, and answers with bad gateway.
+func GetErrorHandler(log *logrus.Logger) func(res http.ResponseWriter, req *http.Request, err error) {
+	return func(res http.ResponseWriter, req *http.Request, err error) {
+		log.WithError(err).WithField("host", req.Host).Error("upstream error")
+
+		if rec, ok := res.(*ResponseRecorder); ok {
+			rec.SetError(err)
+		}
+		res.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, v := range h {
+		res[k] = append([]string(nil), v...)
+	}
+
+	return res
+}
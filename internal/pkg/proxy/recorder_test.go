@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseRecorder(t *testing.T) {
+	res := httptest.NewRecorder()
+	rec := NewResponseRecorder(res)
+
+	rec.Header().Set("Trailer", "X-Sum")
+	rec.Header().Set("Content-Type", "text/plain")
+	rec.WriteHeader(http.StatusCreated)
+	rec.Header().Set("Content-Type", "changed/after-header")
+	_, _ = rec.Write([]byte("hello "))
+	rec.Flush()
+	_, _ = rec.Write([]byte("world"))
+	rec.Header().Set("X-Sum", "42")
+	rec.Header().Set(http.TrailerPrefix+"X-Late", "1")
+
+	saved := rec.Response()
+	if saved.StatusCode != http.StatusCreated {
+		t.Errorf("status %d", saved.StatusCode)
+	}
+	if ct := saved.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("header written after WriteHeader is recorded: %s", ct)
+	}
+	if string(saved.Body) != "hello world" || saved.Truncated {
+		t.Errorf("body %q, truncated %v", saved.Body, saved.Truncated)
+	}
+	if saved.Trailer.Get("X-Sum") != "42" || saved.Trailer.Get("X-Late") != "1" {
+		t.Errorf("trailer %v", saved.Trailer)
+	}
+	if !res.Flushed || res.Body.String() != "hello world" {
+		t.Errorf("flushed %v, passed %q", res.Flushed, res.Body.String())
+	}
+}
+
+func TestResponseRecorderTruncates(t *testing.T) {
+	res := httptest.NewRecorder()
+	rec := NewResponseRecorder(res)
+
+	chunk := bytes.Repeat([]byte{'a'}, 1<<20)
+	for i := 0; i < maxRecordedBody>>20+1; i++ {
+		_, _ = rec.Write(chunk)
+	}
+
+	saved := rec.Response()
+	if saved.StatusCode != http.StatusOK || !saved.Truncated || len(saved.Body) != maxRecordedBody {
+		t.Errorf("status %d, truncated %v, body %d", saved.StatusCode, saved.Truncated, len(saved.Body))
+	}
+	if res.Body.Len() != maxRecordedBody+1<<20 {
+		t.Errorf("passed %d bytes", res.Body.Len())
+	}
+}
+
+func TestNewRequestSaveTruncates(t *testing.T) {
+	body := bytes.Repeat([]byte{'a'}, maxRecordedBody+1<<10)
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/", bytes.NewReader(body))
+
+	rs, err := NewRequestSave(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Truncated || len(rs.Body) != maxRecordedBody {
+		t.Errorf("truncated %v, body %d", rs.Truncated, len(rs.Body))
+	}
+	sent, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, body) {
+		t.Errorf("sent %d bytes of %d", len(sent), len(body))
+	}
+}
+
+type hijackWriter struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+func TestResponseRecorderHijack(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	rec := NewResponseRecorder(httptest.NewRecorder())
+	if _, _, err := rec.Hijack(); err == nil {
+		t.Error("hijacked a writer which can't")
+	}
+
+	rec = NewResponseRecorder(&hijackWriter{ResponseRecorder: httptest.NewRecorder(), conn: server})
+	rec.Header().Set("Upgrade", "websocket")
+	conn, _, err := rec.Hijack()
+	if err != nil || conn != server {
+		t.Fatalf("hijack: %v", err)
+	}
+
+	saved := rec.Response()
+	if saved.StatusCode != http.StatusSwitchingProtocols || saved.Header.Get("Upgrade") != "websocket" {
+		t.Errorf("status %d, header %v", saved.StatusCode, saved.Header)
+	}
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	opcodeText   = 1
+	opcodeBinary = 2
+	opcodeClose  = 8
+
+	// replayCloseWait is how long a replayed session waits for the server
+	// to close after the last client frame.
+	replayCloseWait = 5 * time.Second
+)
+
+var (
+	// ErrNoWebSocket is returned for ids of WebSockets which aren't open.
+	ErrNoWebSocket = errors.New("websocket is not open")
+	// ErrNotWebSocket is returned when replaying a request which didn't
+	// open a WebSocket.
+	ErrNotWebSocket = errors.New("request didn't open a websocket")
+)
+
+// WebSocketMessage is a frame to inject. To is the side it is sent to,
+// Payload is text and PayloadBase64 binary data. Opcode defaults to text or
+// binary by the payload.
+type WebSocketMessage struct {
+	To            string  `json:"to"`
+	Opcode        int     `json:"opcode"`
+	Payload       *string `json:"payload"`
+	PayloadBase64 []byte  `json:"payload_base64"`
+}
+
+func (m *WebSocketMessage) frame() *WebSocketFrame {
+	f := &WebSocketFrame{
+		Time:   time.Now(),
+		Opcode: m.Opcode,
+		Fin:    true,
+	}
+	if m.Payload != nil {
+		f.Payload = []byte(*m.Payload)
+		if f.Opcode == 0 {
+			f.Opcode = opcodeText
+		}
+	} else {
+		f.Payload = m.PayloadBase64
+		if f.Opcode == 0 {
+			f.Opcode = opcodeBinary
+		}
+	}
+	if f.Payload == nil {
+		f.Payload = []byte{}
+	}
+	f.Length = int64(len(f.Payload))
+
+	return f
+}
+
+// WebSockets keeps the proxied WebSockets which are open by the id of
+// their handshake request.
+type WebSockets struct {
+	mu    sync.Mutex
+	conns map[string]*wsConn
+}
+
+func NewWebSockets() *WebSockets {
+	return &WebSockets{conns: make(map[string]*wsConn)}
+}
+
+func (w *WebSockets) add(c *wsConn) {
+	w.mu.Lock()
+	w.conns[c.id] = c
+	w.mu.Unlock()
+}
+
+func (w *WebSockets) remove(id string) {
+	w.mu.Lock()
+	delete(w.conns, id)
+	w.mu.Unlock()
+}
+
+// IDs lists the open WebSockets.
+func (w *WebSockets) IDs() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	ids := make([]string, 0, len(w.conns))
+	for id := range w.conns {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Inject sends m into the open WebSocket id and returns the saved frame,
+// or the queued one when the stream is inside a fragmented message.
+func (w *WebSockets) Inject(id string, m *WebSocketMessage) (*WebSocketFrame, error) {
+	w.mu.Lock()
+	c, ok := w.conns[id]
+	w.mu.Unlock()
+	if !ok {
+		return nil, ErrNoWebSocket
+	}
+
+	return c.inject(m.To, m.frame())
+}
+
+// ReplayWebSocket opens the WebSocket of the saved handshake id again and
+// sends its client frames in order. The new handshake is saved as a child
+// of the old one with the frames of the new session.
+func ReplayWebSocket(client *http.Client, store Store, sockets *WebSockets, id string, log *logrus.Logger) (*RequestSave, error) {
+	saved, err := store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if saved.Response == nil || saved.Response.StatusCode != http.StatusSwitchingProtocols || !IsWebSocketUpgrade(saved.Header) {
+		return nil, ErrNotWebSocket
+	}
+
+	frames, err := store.Frames(id, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	send := make([]*WebSocketFrame, 0, len(frames))
+	for _, f := range frames {
+		if f.Direction != DirectionClient {
+			continue
+		}
+		if f.Truncated {
+			return nil, errors.Errorf("frame %s is truncated", f.ID.Hex())
+		}
+		send = append(send, f)
+	}
+
+	rs := *saved
+	rs.ID = bson.NewObjectId()
+	rs.ParentID = saved.ID
+	rs.Time = time.Now()
+	rs.Response = nil
+	rs.Header = cloneHeader(saved.Header)
+	rs.Header.Set("Sec-WebSocket-Key", newWebSocketKey())
+
+	req := rs.GetHTTPForm()
+	req.URL = rs.TargetURL()
+	req.RequestURI = ""
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't do handshake")
+	}
+	rs.Response = &ResponseSave{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Trailer:    http.Header{},
+		TTFB:       time.Since(started),
+	}
+
+	CaptureWebSocket(resp, &rs, store, sockets, log)
+	ws, ok := resp.Body.(*wsConn)
+	if !ok {
+		rs.Response.Body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		rs.Response.Duration = time.Since(started)
+		if _, err := store.Save(&rs); err != nil {
+			log.WithError(err).Error("can't save replayed request")
+		}
+
+		return &rs, errors.Errorf("upstream answered %s", resp.Status)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, ws)
+		close(done)
+	}()
+
+	closed := false
+	for _, f := range send {
+		if _, err = ws.Write(encodeFrame(f, true)); err != nil {
+			break
+		}
+		closed = f.Opcode == opcodeClose
+		if closed {
+			break
+		}
+	}
+	if err == nil && !closed {
+		_, _ = ws.Write(encodeFrame(&WebSocketFrame{Opcode: opcodeClose, Fin: true, Payload: []byte{0x03, 0xe8}}, true))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(replayCloseWait):
+	}
+	ws.Close()
+	<-done
+	rs.Response.Duration = time.Since(started)
+
+	if _, saveErr := store.Save(&rs); saveErr != nil {
+		return nil, errors.Wrap(saveErr, "can't save replayed request")
+	}
+	if err != nil {
+		return &rs, errors.Wrap(err, "can't send frame")
+	}
+
+	return &rs, nil
+}
+
+func newWebSocketKey() string {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// GetWebSocketsHandler returns handler for GET /websockets, which lists ids
+// of the open WebSockets.
+func GetWebSocketsHandler(sockets *WebSockets) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		OkResponse(res, sockets.IDs())
+	}
+}
+
+// GetInjectHandler returns handler for POST /websockets/{id}, which sends
+// the WebSocketMessage in the body into the open WebSocket.
+func GetInjectHandler(sockets *WebSockets) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		id := mux.Vars(req)["id"]
+
+		m := &WebSocketMessage{}
+		err := json.NewDecoder(req.Body).Decode(m)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse message")
+
+			log.WithError(err).Error("can't parse message")
+			return
+		}
+
+		f, err := sockets.Inject(id, m)
+		if err == ErrNoWebSocket {
+			ErrResponse(res, http.StatusNotFound, err.Error())
+
+			log.WithField("id", id).Error(err)
+			return
+		}
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("can't inject frame")
+			return
+		}
+		OkResponse(res, f)
+	}
+}
+
+// GetReplayHandler returns handler for POST /requests/{id}/replay, which
+// replays the WebSocket opened by the request and returns the new record.
+// Its id is also in the ID header, as for /burst.
+func GetReplayHandler(client *http.Client, store Store, sockets *WebSockets) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		id := mux.Vars(req)["id"]
+
+		rs, err := ReplayWebSocket(client, store, sockets, id, log)
+		if rs != nil {
+			res.Header().Set("ID", rs.ID.Hex())
+		}
+		switch {
+		case err == ErrNotFound:
+			ErrResponse(res, http.StatusNotFound, "request not found")
+
+			log.WithField("id", id).Error("request not found")
+			return
+		case err == ErrNotWebSocket:
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithField("id", id).Error(err)
+			return
+		case err != nil:
+			ErrResponse(res, http.StatusBadGateway, err.Error())
+
+			log.WithError(err).Error("can't replay websocket")
+			return
+		}
+		OkResponse(res, rs)
+	}
+}
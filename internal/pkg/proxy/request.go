@@ -2,36 +2,76 @@ package proxy
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"gopkg.in/mgo.v2"
-
 	"gopkg.in/mgo.v2/bson"
 )
 
 type RequestSave struct {
-	ID               bson.ObjectId   `bson:"_id"`
-	Method           string          `bson:"method"`
-	URL              *url.URL        `bson:"url"`
-	Proto            string          `bson:"proto"`
-	ProtoMajor       int             `bson:"proto_major"`
-	ProtoMinor       int             `bson:"proto_minor"`
-	Header           http.Header     `bson:"header"`
-	Body             []byte          `bson:"body"`
-	ContentLength    int64           `bson:"content_length"`
-	TransferEncoding []string        `bson:"transfer_encoding"`
-	Host             string          `bson:"host"`
-	Form             url.Values      `bson:"form"`
-	PostForm         url.Values      `bson:"post_form"`
-	MultipartForm    *multipart.Form `bson:"multipart_form"`
-	Trailer          http.Header     `bson:"trailer"`
-	RemoteAddr       string          `bson:"remote_addr"`
-	RequestURI       string          `bson:"request_uri"`
+	ID               bson.ObjectId    `bson:"_id" json:"id"`
+	ParentID         bson.ObjectId    `bson:"parent_id,omitempty" json:"parent_id,omitempty"`
+	Method           string           `bson:"method" json:"method"`
+	URL              *url.URL         `bson:"url" json:"url"`
+	Proto            string           `bson:"proto" json:"proto"`
+	ProtoMajor       int              `bson:"proto_major" json:"proto_major"`
+	ProtoMinor       int              `bson:"proto_minor" json:"proto_minor"`
+	Header           http.Header      `bson:"header" json:"header"`
+	Body             []byte           `bson:"body" json:"body"`
+	Truncated        bool             `bson:"truncated,omitempty" json:"truncated,omitempty"`
+	ContentLength    int64            `bson:"content_length" json:"content_length"`
+	TransferEncoding []string         `bson:"transfer_encoding" json:"transfer_encoding"`
+	Host             string           `bson:"host" json:"host"`
+	Form             url.Values       `bson:"form" json:"form"`
+	PostForm         url.Values       `bson:"post_form" json:"post_form"`
+	MultipartForm    *multipart.Form  `bson:"multipart_form" json:"multipart_form"`
+	Trailer          http.Header      `bson:"trailer" json:"trailer"`
+	RemoteAddr       string           `bson:"remote_addr" json:"remote_addr"`
+	RequestURI       string           `bson:"request_uri" json:"request_uri"`
+	Time             time.Time        `bson:"time" json:"time"`
+	Response         *ResponseSave    `bson:"response,omitempty" json:"response"`
+	Imported         bool             `bson:"imported,omitempty" json:"imported,omitempty"`
+	Rules            []string         `bson:"rules,omitempty" json:"rules,omitempty"`
+	UpstreamTLS      *TLSVerification `bson:"upstream_tls,omitempty" json:"upstream_tls,omitempty"`
+	ClientProtocol   string           `bson:"client_protocol,omitempty" json:"client_protocol,omitempty"`
+	UpstreamProtocol string           `bson:"upstream_protocol,omitempty" json:"upstream_protocol,omitempty"`
+}
+
+type ctxRequestSave struct{}
+
+// WithRequestSave puts the record of the request being proxied to context.
+func WithRequestSave(ctx context.Context, rs *RequestSave) context.Context {
+	return context.WithValue(ctx, ctxRequestSave{}, rs)
+}
+
+// RequestSaveFromContext gets the record put by WithRequestSave, if any.
+func RequestSaveFromContext(ctx context.Context) *RequestSave {
+	rs, _ := ctx.Value(ctxRequestSave{}).(*RequestSave)
+	return rs
+}
+
+// TargetURL returns a copy of the saved url completed with host and scheme,
+// so it can be sent again.
+func (rs *RequestSave) TargetURL() *url.URL {
+	u := &url.URL{}
+	if rs.URL != nil {
+		*u = *rs.URL
+	}
+	u.Host = rs.Host
+	if u.Scheme == "" {
+		u.Scheme = strings.ToLower(strings.Split(rs.Proto, "/")[0])
+	}
+
+	return u
 }
 
 func (rs *RequestSave) GetHTTPForm() *http.Request {
@@ -55,17 +95,82 @@ func (rs *RequestSave) GetHTTPForm() *http.Request {
 	}
 }
 
-func SaveRequest(req *http.Request, collection *mgo.Collection) (string, error) {
-	b, _ := ioutil.ReadAll(req.Body)
-	reqSave := RequestSave{
+// NegotiatedProtocol returns the ALPN protocol of a connection, or the one
+// implied by the major HTTP version when there was no ALPN.
+func NegotiatedProtocol(state *tls.ConnectionState, protoMajor int) string {
+	if state != nil && state.NegotiatedProtocol != "" {
+		return state.NegotiatedProtocol
+	}
+	if protoMajor == 2 {
+		return "h2"
+	}
+
+	return "http/1.1"
+}
+
+// NewRequestSave copies req into a new record. The request body is read
+// and replaced, so req can still be sent upstream.
+// A readCloser reads from Reader and closes Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// RequestTargetURL returns the url req is sent to, the same as TargetURL of
+// its record, without reading the body.
+func RequestTargetURL(req *http.Request) *url.URL {
+	u := requestURL(req)
+	u.Host = req.Host
+
+	return u
+}
+
+// requestURL is the url of req with the scheme and host filled in.
+func requestURL(req *http.Request) *url.URL {
+	u := *req.URL
+	if u.Scheme == "" {
+		u.Scheme = "http"
+		if req.TLS != nil {
+			u.Scheme = "https"
+		}
+	}
+	if u.Host == "" {
+		u.Host = req.Host
+	}
+
+	return &u
+}
+
+func NewRequestSave(req *http.Request) (*RequestSave, error) {
+	var b []byte
+	truncated := false
+	if req.Body != nil {
+		var err error
+		b, err = ioutil.ReadAll(io.LimitReader(req.Body, maxRecordedBody+1))
+		if err != nil {
+			return nil, errors.Wrap(err, "can't read request body")
+		}
+		if len(b) > maxRecordedBody {
+			// the rest is streamed upstream without being kept
+			truncated = true
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+			b = b[:maxRecordedBody]
+		} else {
+			req.Body.Close()
+			req.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+	}
+
+	return &RequestSave{
 		ID:               bson.NewObjectId(),
 		Method:           req.Method,
-		URL:              req.URL,
+		URL:              requestURL(req),
 		Proto:            req.Proto,
 		ProtoMajor:       req.ProtoMajor,
 		ProtoMinor:       req.ProtoMinor,
 		Header:           req.Header,
 		Body:             b,
+		Truncated:        truncated,
 		ContentLength:    req.ContentLength,
 		TransferEncoding: req.TransferEncoding,
 		Host:             req.Host,
@@ -75,22 +180,7 @@ func SaveRequest(req *http.Request, collection *mgo.Collection) (string, error)
 		Trailer:          req.Trailer,
 		RemoteAddr:       req.RemoteAddr,
 		RequestURI:       req.RequestURI,
-	}
-
-	err := collection.Insert(reqSave)
-	if err != nil {
-		return "", errors.Wrap(err, "can't insert request")
-	}
-
-	return reqSave.ID.Hex(), nil
-}
-
-func GetSavedRequest(id string, collection *mgo.Collection) (*http.Request, error) {
-	r := &RequestSave{}
-	err := collection.FindId(bson.ObjectIdHex(id)).One(r)
-	if err != nil {
-		return nil, errors.Wrap(err, "can't get request")
-	}
-
-	return r.GetHTTPForm(), nil
+		ClientProtocol:   NegotiatedProtocol(req.TLS, req.ProtoMajor),
+		Time:             time.Now(),
+	}, nil
 }
@@ -26,6 +26,7 @@ func addBody(res io.Writer, bodyMessage interface{}) {
 }
 
 func OkResponse(res http.ResponseWriter, bodyMessage interface{}) {
+	res.Header().Set("Content-Type", "application/json")
 	addOkHeader(res)
 	addBody(res, bodyMessage)
 }
@@ -0,0 +1,409 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+const (
+	RuleRequestHeader  = "request_header"
+	RuleRequestURL     = "request_url"
+	RuleRequestBody    = "request_body"
+	RuleResponseHeader = "response_header"
+	RuleResponseBody   = "response_body"
+	RuleResponseStatus = "response_status"
+)
+
+// A Rule replaces Match regexp with Replace in the part of the message
+// given by Type. Header rules work on "Name: value" lines: an empty Match
+// adds Replace as a new header and an empty result removes the header.
+// Status rules match the status code as text and replace it with a new one.
+// Body rules see gzip and deflate bodies decoded, which are sent on so.
+type Rule struct {
+	Name    string `yaml:"name" json:"name"`
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Type    string `yaml:"type" json:"type"`
+	Match   string `yaml:"match" json:"match"`
+	Replace string `yaml:"replace" json:"replace"`
+
+	re *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	switch r.Type {
+	case RuleRequestHeader, RuleRequestURL, RuleRequestBody,
+		RuleResponseHeader, RuleResponseBody, RuleResponseStatus:
+	default:
+		return errors.Errorf("rule %q has unknown type %q", r.Name, r.Type)
+	}
+	if r.Name == "" {
+		return errors.New("rule name is required")
+	}
+
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return errors.Wrapf(err, "rule %q has bad match regexp", r.Name)
+	}
+	r.re = re
+
+	return nil
+}
+
+// replaceHeader applies a header rule to h and reports whether it changed.
+func (r *Rule) replaceHeader(h http.Header) bool {
+	if r.Match == "" {
+		parts := strings.SplitN(r.Replace, ":", 2)
+		if len(parts) != 2 {
+			return false
+		}
+		h.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+
+		return true
+	}
+
+	changed := false
+	res := http.Header{}
+	for k, values := range h {
+		for _, v := range values {
+			line := k + ": " + v
+			if !r.re.MatchString(line) {
+				res.Add(k, v)
+				continue
+			}
+
+			changed = true
+			line = r.re.ReplaceAllString(line, r.Replace)
+			if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+				res.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			}
+		}
+	}
+	if changed {
+		for k := range h {
+			delete(h, k)
+		}
+		for k, v := range res {
+			h[k] = v
+		}
+	}
+
+	return changed
+}
+
+func (r *Rule) replaceBody(body []byte) ([]byte, bool) {
+	if !r.re.Match(body) {
+		return body, false
+	}
+
+	return r.re.ReplaceAll(body, []byte(r.Replace)), true
+}
+
+// RuleSet keeps ordered match and replace rules.
+type RuleSet struct {
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	rs := &RuleSet{}
+	err := rs.SetRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+func (s *RuleSet) Rules() []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Rule, len(s.rules))
+	copy(res, s.rules)
+
+	return res
+}
+
+func (s *RuleSet) SetRules(rules []Rule) error {
+	compiled := make([]Rule, len(rules))
+	copy(compiled, rules)
+	names := make(map[string]bool, len(rules))
+	for i := range compiled {
+		if err := compiled[i].compile(); err != nil {
+			return err
+		}
+		if names[compiled[i].Name] {
+			return errors.Errorf("rule %q is duplicated", compiled[i].Name)
+		}
+		names[compiled[i].Name] = true
+	}
+
+	s.mu.Lock()
+	s.rules = compiled
+	s.mu.Unlock()
+
+	return nil
+}
+
+// SetEnabled toggles the rule called name.
+func (s *RuleSet) SetEnabled(name string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.rules {
+		if s.rules[i].Name == name {
+			s.rules[i].Enabled = enabled
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+func (s *RuleSet) enabled(types ...string) []Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Rule, 0, len(s.rules))
+	for _, r := range s.rules {
+		if !r.Enabled {
+			continue
+		}
+		for _, t := range types {
+			if r.Type == t {
+				res = append(res, r)
+				break
+			}
+		}
+	}
+
+	return res
+}
+
+// ApplyRequest rewrites the outgoing req. Names of the rules which changed
+// something are added to the record in the request context.
+func (s *RuleSet) ApplyRequest(req *http.Request) error {
+	if s == nil {
+		return nil
+	}
+	rules := s.enabled(RuleRequestHeader, RuleRequestURL, RuleRequestBody)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var body []byte
+	bodyRead := false
+	fired := make([]string, 0)
+	for i := range rules {
+		r := &rules[i]
+		switch r.Type {
+		case RuleRequestHeader:
+			if r.replaceHeader(req.Header) {
+				fired = append(fired, r.Name)
+			}
+		case RuleRequestURL:
+			u := req.URL.String()
+			if !r.re.MatchString(u) {
+				continue
+			}
+			parsed, err := url.Parse(r.re.ReplaceAllString(u, r.Replace))
+			if err != nil {
+				return errors.Wrapf(err, "rule %q made bad url", r.Name)
+			}
+			req.URL = parsed
+			req.Host = parsed.Host
+			fired = append(fired, r.Name)
+		case RuleRequestBody:
+			if !bodyRead {
+				var err error
+				body, err = readBody(req.Body)
+				if err != nil {
+					return err
+				}
+				// a broken encoding is matched as is
+				if decoded, _, err := decodeBody(req.Header, body); err == nil {
+					body = decoded
+				}
+				bodyRead = true
+			}
+			var changed bool
+			body, changed = r.replaceBody(body)
+			if changed {
+				fired = append(fired, r.Name)
+			}
+		}
+	}
+
+	if bodyRead {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.TransferEncoding = nil
+		req.Header.Del("Content-Length")
+	}
+	addFiredRules(req, fired)
+
+	return nil
+}
+
+// ApplyResponse rewrites resp the way ApplyRequest does for requests.
+func (s *RuleSet) ApplyResponse(resp *http.Response) error {
+	if s == nil {
+		return nil
+	}
+	rules := s.enabled(RuleResponseHeader, RuleResponseBody, RuleResponseStatus)
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var body []byte
+	bodyRead := false
+	fired := make([]string, 0)
+	for i := range rules {
+		r := &rules[i]
+		switch r.Type {
+		case RuleResponseHeader:
+			if r.replaceHeader(resp.Header) {
+				fired = append(fired, r.Name)
+			}
+		case RuleResponseStatus:
+			status := strconv.Itoa(resp.StatusCode)
+			if !r.re.MatchString(status) {
+				continue
+			}
+			code, err := strconv.Atoi(r.re.ReplaceAllString(status, r.Replace))
+			if err != nil || code < 100 || code > 999 {
+				return errors.Errorf("rule %q made bad status code", r.Name)
+			}
+			resp.StatusCode = code
+			resp.Status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+			fired = append(fired, r.Name)
+		case RuleResponseBody:
+			if !bodyRead {
+				var err error
+				body, err = readBody(resp.Body)
+				if err != nil {
+					return err
+				}
+				// a broken encoding is matched as is
+				if decoded, _, err := decodeBody(resp.Header, body); err == nil {
+					body = decoded
+				}
+				bodyRead = true
+			}
+			var changed bool
+			body, changed = r.replaceBody(body)
+			if changed {
+				fired = append(fired, r.Name)
+			}
+		}
+	}
+
+	if bodyRead {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.TransferEncoding = nil
+		resp.Header.Del("Transfer-Encoding")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	addFiredRules(resp.Request, fired)
+
+	return nil
+}
+
+func readBody(body io.ReadCloser) ([]byte, error) {
+	if body == nil || body == http.NoBody {
+		return []byte{}, nil
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read body")
+	}
+
+	return b, nil
+}
+
+func addFiredRules(req *http.Request, fired []string) {
+	if req == nil || len(fired) == 0 {
+		return
+	}
+	if rs := RequestSaveFromContext(req.Context()); rs != nil {
+		rs.Rules = append(rs.Rules, fired...)
+	}
+}
+
+// GetRulesHandler returns handler for GET /rules.
+func GetRulesHandler(s *RuleSet) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		OkResponse(res, s.Rules())
+	}
+}
+
+// GetSetRulesHandler returns handler for PUT /rules, which replaces all the
+// rules with the ordered list from the body. The change lives until restart,
+// the rules of the config file are loaded again then.
+func GetSetRulesHandler(s *RuleSet) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+
+		rules := make([]Rule, 0)
+		err := json.NewDecoder(req.Body).Decode(&rules)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse rules")
+
+			log.WithError(err).Error("can't parse rules")
+			return
+		}
+
+		err = s.SetRules(rules)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("can't set rules")
+			return
+		}
+		OkResponse(res, s.Rules())
+	}
+}
+
+// GetToggleRuleHandler returns handler for PUT /rules/{name}, which takes
+// {"enabled": bool} from the body. Like PUT /rules, it isn't persisted.
+func GetToggleRuleHandler(s *RuleSet) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		name := mux.Vars(req)["name"]
+
+		toggle := struct {
+			Enabled bool `json:"enabled"`
+		}{}
+		err := json.NewDecoder(req.Body).Decode(&toggle)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse body")
+
+			log.WithError(err).Error("can't parse body")
+			return
+		}
+
+		err = s.SetEnabled(name, toggle.Enabled)
+		if err == ErrNotFound {
+			ErrResponse(res, http.StatusNotFound, "rule not found")
+
+			log.WithField("name", name).Error("rule not found")
+			return
+		}
+		OkResponse(res, s.Rules())
+	}
+}
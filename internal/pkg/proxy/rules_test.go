@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestRuleCompile(t *testing.T) {
+	for _, tc := range []struct {
+		rule Rule
+		ok   bool
+	}{
+		{Rule{Name: "a", Type: RuleResponseBody, Match: "x+"}, true},
+		{Rule{Name: "a", Type: RuleRequestHeader}, true},
+		{Rule{Name: "", Type: RuleResponseBody}, false},
+		{Rule{Name: "a", Type: "cookie"}, false},
+		{Rule{Name: "a", Type: RuleRequestURL, Match: "("}, false},
+	} {
+		if err := tc.rule.compile(); (err == nil) != tc.ok {
+			t.Errorf("%+v: %v", tc.rule, err)
+		}
+	}
+
+	if _, err := NewRuleSet([]Rule{{Name: "a", Type: RuleRequestURL}, {Name: "a", Type: RuleRequestBody}}); err == nil {
+		t.Error("duplicated names accepted")
+	}
+}
+
+func compiledRule(t *testing.T, r Rule) *Rule {
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &r
+}
+
+func TestReplaceHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rule    Rule
+		changed bool
+		want    http.Header
+	}{
+		{
+			"add", Rule{Replace: "X-New: 1"}, true,
+			http.Header{"Accept": {"*/*"}, "User-Agent": {"curl"}, "X-New": {"1"}},
+		},
+		{
+			"replace value", Rule{Match: `^User-Agent: .*$`, Replace: "User-Agent: proxy"}, true,
+			http.Header{"Accept": {"*/*"}, "User-Agent": {"proxy"}},
+		},
+		{
+			"rename", Rule{Match: `^Accept:`, Replace: "X-Accept:"}, true,
+			http.Header{"X-Accept": {"*/*"}, "User-Agent": {"curl"}},
+		},
+		{
+			"remove", Rule{Match: `^Accept: .*$`}, true,
+			http.Header{"User-Agent": {"curl"}},
+		},
+		{
+			"no match", Rule{Match: `^Cookie:`}, false,
+			http.Header{"Accept": {"*/*"}, "User-Agent": {"curl"}},
+		},
+	} {
+		tc.rule.Name, tc.rule.Type = tc.name, RuleRequestHeader
+		h := http.Header{"Accept": {"*/*"}, "User-Agent": {"curl"}}
+		changed := compiledRule(t, tc.rule).replaceHeader(h)
+		if changed != tc.changed || len(h) != len(tc.want) {
+			t.Errorf("%s: changed %v, got %v", tc.name, changed, h)
+			continue
+		}
+		for k := range tc.want {
+			if h.Get(k) != tc.want.Get(k) {
+				t.Errorf("%s: got %v, want %v", tc.name, h, tc.want)
+			}
+		}
+	}
+}
+
+func TestReplaceBody(t *testing.T) {
+	r := compiledRule(t, Rule{Name: "a", Type: RuleResponseBody, Match: `"admin":\s*false`, Replace: `"admin": true`})
+
+	body, changed := r.replaceBody([]byte(`{"admin": false, "x": "admin:false"}`))
+	if !changed || string(body) != `{"admin": true, "x": "admin:false"}` {
+		t.Errorf("changed %v, got %s", changed, body)
+	}
+	if body, changed = r.replaceBody([]byte("{}")); changed || string(body) != "{}" {
+		t.Errorf("changed %v, got %s", changed, body)
+	}
+}
+
+func gzipped(s string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, _ = zw.Write([]byte(s))
+	_ = zw.Close()
+
+	return buf.Bytes()
+}
+
+func TestRuleSetApplyResponse(t *testing.T) {
+	set, err := NewRuleSet([]Rule{
+		{Name: "body", Enabled: true, Type: RuleResponseBody, Match: "world", Replace: "proxy"},
+		{Name: "status", Enabled: true, Type: RuleResponseStatus, Match: "^404$", Replace: "200"},
+		{Name: "header", Enabled: true, Type: RuleResponseHeader, Replace: "X-Rules: on"},
+		{Name: "off", Type: RuleResponseBody, Match: "hello", Replace: "bye"},
+		{Name: "request", Enabled: true, Type: RuleRequestBody, Match: "hello", Replace: "bye"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   []byte
+	}{
+		{"plain", http.Header{}, []byte("hello world")},
+		{"gzip", http.Header{"Content-Encoding": {"gzip"}}, gzipped("hello world")},
+	} {
+		rs := &RequestSave{}
+		req, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req = req.WithContext(WithRequestSave(req.Context(), rs))
+		tc.header.Set("Content-Length", strconv.Itoa(len(tc.body)))
+		resp := &http.Response{
+			StatusCode: http.StatusNotFound,
+			Header:     tc.header,
+			Body:       ioutil.NopCloser(bytes.NewReader(tc.body)),
+			Request:    req,
+		}
+
+		if err := set.ApplyResponse(resp); err != nil {
+			t.Fatal(err)
+		}
+
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != "hello proxy" || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s: body %q, length %s", tc.name, body, resp.Header.Get("Content-Length"))
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: decoded body sent as %s", tc.name, resp.Header.Get("Content-Encoding"))
+		}
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Rules") != "on" {
+			t.Errorf("%s: status %d, header %v", tc.name, resp.StatusCode, resp.Header)
+		}
+		if len(rs.Rules) != 3 {
+			t.Errorf("%s: fired rules %v", tc.name, rs.Rules)
+		}
+	}
+}
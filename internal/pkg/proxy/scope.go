@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ScopeRule matches urls by host glob, path regexp, port and scheme.
+// Empty fields match everything.
+type ScopeRule struct {
+	Host   string `yaml:"host" json:"host"`
+	Path   string `yaml:"path" json:"path"`
+	Port   int    `yaml:"port" json:"port"`
+	Scheme string `yaml:"scheme" json:"scheme"`
+
+	m hostPathMatcher
+}
+
+func (r *ScopeRule) compile() error {
+	var err error
+	r.m, err = newHostPathMatcher(r.Host, r.Path)
+
+	return err
+}
+
+// match reports whether the rule matches the url. A url without path, as
+// in CONNECT, matches path rules too, since any path of it may.
+func (r *ScopeRule) match(u *url.URL) bool {
+	if r.Scheme != "" && !strings.EqualFold(r.Scheme, u.Scheme) {
+		return false
+	}
+	if !r.m.matchHost(u.Hostname()) {
+		return false
+	}
+	if r.Port != 0 && r.Port != urlPort(u) {
+		return false
+	}
+	if u.Path != "" && !r.m.matchPath(u.Path) {
+		return false
+	}
+
+	return true
+}
+
+func urlPort(u *url.URL) int {
+	if p, err := strconv.Atoi(u.Port()); err == nil {
+		return p
+	}
+	if strings.EqualFold(u.Scheme, "https") {
+		return 443
+	}
+
+	return 80
+}
+
+// ScopeSettings select the traffic the proxy cares about: a url is in scope
+// when it matches any Include rule, or there are none, and no Exclude rule.
+type ScopeSettings struct {
+	Include []ScopeRule `yaml:"include" json:"include"`
+	Exclude []ScopeRule `yaml:"exclude" json:"exclude"`
+}
+
+// Scope decides which flows are recorded and intercepted. A nil Scope has
+// everything in scope.
+type Scope struct {
+	mu       sync.RWMutex
+	settings ScopeSettings
+}
+
+func NewScope(settings ScopeSettings) (*Scope, error) {
+	s := &Scope{}
+	err := s.SetSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Scope) Settings() ScopeSettings {
+	if s == nil {
+		return ScopeSettings{}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.settings
+}
+
+func (s *Scope) SetSettings(settings ScopeSettings) error {
+	var err error
+	settings.Include, err = compileScopeRules(settings.Include)
+	if err != nil {
+		return err
+	}
+	settings.Exclude, err = compileScopeRules(settings.Exclude)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.settings = settings
+	s.mu.Unlock()
+
+	return nil
+}
+
+func compileScopeRules(rules []ScopeRule) ([]ScopeRule, error) {
+	res := make([]ScopeRule, len(rules))
+	copy(res, rules)
+	for i := range res {
+		if err := res[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// InScope reports whether u is in scope. For exclusion rules with a path
+// a url without path is kept in scope, as only some of its paths are out.
+func (s *Scope) InScope(u *url.URL) bool {
+	if s == nil {
+		return true
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	included := len(s.settings.Include) == 0
+	for i := range s.settings.Include {
+		if s.settings.Include[i].match(u) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for i := range s.settings.Exclude {
+		r := &s.settings.Exclude[i]
+		if r.m.hasPath() && u.Path == "" {
+			continue
+		}
+		if r.match(u) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GetScopeHandler returns handler for GET /scope.
+func GetScopeHandler(s *Scope) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		OkResponse(res, s.Settings())
+	}
+}
+
+// GetSetScopeHandler returns handler for PUT /scope, which replaces the
+// scope with ScopeSettings from the body.
+func GetSetScopeHandler(s *Scope) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+
+		settings := ScopeSettings{}
+		err := json.NewDecoder(req.Body).Decode(&settings)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, "can't parse scope")
+
+			log.WithError(err).Error("can't parse scope")
+			return
+		}
+
+		err = s.SetSettings(settings)
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("can't set scope")
+			return
+		}
+		OkResponse(res, s.Settings())
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScopeInScope(t *testing.T) {
+	s, err := NewScope(ScopeSettings{
+		Include: []ScopeRule{
+			{Host: "*.Example.com"},
+			{Host: "api.test", Path: "^/v1/", Scheme: "https"},
+		},
+		Exclude: []ScopeRule{
+			{Host: "static.example.com"},
+			{Host: "*.example.com", Path: `\.png$`},
+			{Host: "*.example.com", Port: 8080},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url string
+		in  bool
+	}{
+		{"http://www.example.com/", true},
+		{"http://WWW.EXAMPLE.COM/a", true},
+		{"http://example.com/", false},
+		{"http://other.com/", false},
+		{"https://api.test/v1/users", true},
+		{"http://api.test/v1/users", false},
+		{"https://api.test/v2/users", false},
+		{"http://static.example.com/app.js", false},
+		{"http://www.example.com/logo.png", false},
+		{"http://www.example.com:8080/", false},
+		{"https://www.example.com:443/", true},
+		// CONNECT targets have no path, so path exclusions keep them.
+		{"https://www.example.com:443", true},
+		{"https://static.example.com:443", false},
+		// and include paths let them in, as some of their paths are in.
+		{"https://api.test:443", true},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in := s.InScope(u); in != tc.in {
+			t.Errorf("%s: in scope %v", tc.url, in)
+		}
+	}
+
+	var nilScope *Scope
+	if !nilScope.InScope(&url.URL{Host: "a"}) {
+		t.Error("nil scope excludes")
+	}
+	if _, err = NewScope(ScopeSettings{Include: []ScopeRule{{Host: "["}}}); err == nil {
+		t.Error("bad host glob accepted")
+	}
+	if _, err = NewScope(ScopeSettings{Exclude: []ScopeRule{{Path: "("}}}); err == nil {
+		t.Error("bad path regexp accepted")
+	}
+}
+
+func TestRequestTargetURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://a.example.com/x?y=1", nil)
+	if u := RequestTargetURL(req).String(); u != "http://a.example.com/x?y=1" {
+		t.Errorf("proxy request url %s", u)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/x", nil)
+	req.Host = "b.example.com:8443"
+	req.TLS = &tls.ConnectionState{}
+	if u := RequestTargetURL(req).String(); u != "https://b.example.com:8443/x" {
+		t.Errorf("mitm request url %s", u)
+	}
+}
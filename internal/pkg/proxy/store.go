@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by Store implementations when there is no saved
+// request with the given id.
+var ErrNotFound = errors.New("request not found")
+
+// Filter selects saved requests. Zero fields match everything.
+type Filter struct {
+	Host        string
+	Method      string
+	Path        string
+	StatusCode  int
+	ContentType string
+	From        time.Time
+	To          time.Time
+}
+
+// Match reports whether rs passes the filter. Host is compared without
+// port, Path and ContentType are substrings.
+func (f *Filter) Match(rs *RequestSave) bool {
+	if f.Host != "" && !strings.EqualFold(f.Host, rs.Host) && !strings.EqualFold(f.Host, Hostname(rs.Host)) {
+		return false
+	}
+	if f.Method != "" && !strings.EqualFold(f.Method, rs.Method) {
+		return false
+	}
+	if f.Path != "" && (rs.URL == nil || !strings.Contains(rs.URL.Path, f.Path)) {
+		return false
+	}
+	if f.StatusCode != 0 && (rs.Response == nil || rs.Response.StatusCode != f.StatusCode) {
+		return false
+	}
+	if f.ContentType != "" && (rs.Response == nil || !strings.Contains(rs.Response.Header.Get("Content-Type"), f.ContentType)) {
+		return false
+	}
+	if !f.From.IsZero() && rs.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !rs.Time.Before(f.To) {
+		return false
+	}
+
+	return true
+}
+
+// ListOptions limits the records returned by Store.List.
+type ListOptions struct {
+	Offset int
+	Limit  int
+	Filter Filter
+	// Oldest lists records from the oldest one instead of the newest.
+	Oldest bool
+}
+
+// Store keeps saved requests.
+type Store interface {
+	// Save inserts rs, or replaces the record saved with its id.
+	Save(rs *RequestSave) (string, error)
+	Get(id string) (*RequestSave, error)
+	List(opts ListOptions) ([]*RequestSave, error)
+	// Delete removes the record with its WebSocket frames.
+	Delete(id string) error
+	// SaveFrame and Frames keep frames of WebSocket connections, listed
+	// in the order they were sent.
+	SaveFrame(f *WebSocketFrame) error
+	Frames(connectionID string, offset, limit int) ([]*WebSocketFrame, error)
+	Close() error
+}
+
+// Hostname strips the port from host, if there is one.
+func Hostname(host string) string {
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+
+	return h
+}
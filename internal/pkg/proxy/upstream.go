@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxVerifyCache bounds the remembered verification outcomes.
+	maxVerifyCache      = 1024
+	upstreamDialTimeout = 30 * time.Second
+)
+
+// ClientCert is a certificate and key pair presented to mTLS upstreams.
+type ClientCert struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// UpstreamTLSRule sets TLS of connections to upstreams matching Host glob.
+// Versions are "1.0" to "1.3", cipher suites are Go names of them.
+type UpstreamTLSRule struct {
+	Host               string       `yaml:"host"`
+	RootCAs            []string     `yaml:"root_cas"`
+	InsecureSkipVerify bool         `yaml:"insecure_skip_verify"`
+	MinVersion         string       `yaml:"min_version"`
+	MaxVersion         string       `yaml:"max_version"`
+	CipherSuites       []string     `yaml:"cipher_suites"`
+	ClientCerts        []ClientCert `yaml:"client_certs"`
+}
+
+// TLSVerification is the outcome of upstream certificate verification
+// saved with a flow. An upstream with skipped verification is still
+// checked, so Verified tells whether it would have been accepted.
+type TLSVerification struct {
+	Verified   bool   `bson:"verified" json:"verified"`
+	Error      string `bson:"error,omitempty" json:"error,omitempty"`
+	SkipVerify bool   `bson:"skip_verify,omitempty" json:"skip_verify,omitempty"`
+	Version    string `bson:"version" json:"version"`
+	Cipher     string `bson:"cipher" json:"cipher"`
+}
+
+type upstreamTLSHost struct {
+	host   string
+	config *tls.Config
+}
+
+// UpstreamTLS picks the tls.Config for upstream connections by host. The
+// first rule matching the host wins; hosts without a rule use the base.
+type UpstreamTLS struct {
+	base  *tls.Config
+	hosts []upstreamTLSHost
+
+	mu       sync.Mutex
+	verified map[string]TLSVerification
+}
+
+func NewUpstreamTLS(rules []UpstreamTLSRule, base *tls.Config) (*UpstreamTLS, error) {
+	if base == nil {
+		base = &tls.Config{}
+	}
+
+	u := &UpstreamTLS{
+		base:     base,
+		verified: make(map[string]TLSVerification),
+	}
+	for _, r := range rules {
+		config, err := r.config(base)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad upstream tls for %q", r.Host)
+		}
+		u.hosts = append(u.hosts, upstreamTLSHost{host: strings.ToLower(r.Host), config: config})
+	}
+
+	return u, nil
+}
+
+func (r *UpstreamTLSRule) config(base *tls.Config) (*tls.Config, error) {
+	if err := checkHostGlob(r.Host); err != nil {
+		return nil, err
+	}
+
+	config := base.Clone()
+	config.InsecureSkipVerify = r.InsecureSkipVerify
+
+	if len(r.RootCAs) != 0 {
+		config.RootCAs = x509.NewCertPool()
+		for _, file := range r.RootCAs {
+			pem, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't read root CA")
+			}
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("no certificates in %s", file)
+			}
+		}
+	}
+
+	var err error
+	if r.MinVersion != "" {
+		config.MinVersion, err = tlsVersion(r.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.MaxVersion != "" {
+		config.MaxVersion, err = tlsVersion(r.MaxVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(r.CipherSuites) != 0 {
+		config.CipherSuites = make([]uint16, 0, len(r.CipherSuites))
+		for _, name := range r.CipherSuites {
+			id, ok := cipherSuiteID(name)
+			if !ok {
+				return nil, errors.Errorf("unknown cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	for _, c := range r.ClientCerts {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't load client certificate")
+		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+
+	return config, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsVersion(v string) (uint16, error) {
+	id, ok := tlsVersions[v]
+	if !ok {
+		return 0, errors.Errorf("unknown tls version %q", v)
+	}
+
+	return id, nil
+}
+
+func tlsVersionName(id uint16) string {
+	for name, v := range tlsVersions {
+		if v == id {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, list := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, s := range list {
+			if s.Name == name {
+				return s.ID, true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func (u *UpstreamTLS) hostConfig(host string) *tls.Config {
+	host = strings.ToLower(host)
+	for _, h := range u.hosts {
+		if matchHostGlob(h.host, host) {
+			return h.config
+		}
+	}
+
+	return u.base
+}
+
+// Config returns a copy of the config for connections to host, which may
+// have a port. serverName is sent as SNI when it is not empty.
+func (u *UpstreamTLS) Config(host, serverName string) *tls.Config {
+	if u == nil {
+		return &tls.Config{ServerName: serverName}
+	}
+
+	config := u.hostConfig(Hostname(host)).Clone()
+	config.ServerName = serverName
+
+	return config
+}
+
+// DialTLS connects to addr with the TLS config of its host, for requests
+// the proxy sends itself, like bursts and WebSocket replays.
+func (u *UpstreamTLS) DialTLS(network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: upstreamDialTimeout}
+
+	return tls.DialWithDialer(dialer, network, addr, u.Config(addr, Hostname(addr)))
+}
+
+// Verify checks the certificates of the upstream connection to host
+// against the roots configured for it.
+func (u *UpstreamTLS) Verify(host string, state *tls.ConnectionState) *TLSVerification {
+	if u == nil || state == nil {
+		return nil
+	}
+
+	host = Hostname(host)
+	config := u.hostConfig(host)
+	res := TLSVerification{
+		SkipVerify: config.InsecureSkipVerify,
+		Version:    tlsVersionName(state.Version),
+		Cipher:     tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) == 0 {
+		res.Error = "no peer certificates"
+		return &res
+	}
+
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	key := host + "@" + string(sum[:])
+	u.mu.Lock()
+	cached, ok := u.verified[key]
+	u.mu.Unlock()
+	if ok {
+		res.Verified, res.Error = cached.Verified, cached.Error
+		return &res
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         config.RootCAs,
+		DNSName:       strings.Trim(host, "[]"),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := state.PeerCertificates[0].Verify(opts)
+	res.Verified = err == nil
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	u.mu.Lock()
+	if len(u.verified) >= maxVerifyCache {
+		u.verified = make(map[string]TLSVerification)
+	}
+	u.verified[key] = res
+	u.mu.Unlock()
+
+	return &res
+}
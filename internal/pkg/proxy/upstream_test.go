@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "upstream-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootFile := filepath.Join(dir, "root.pem")
+	root := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(rootFile, root, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewUpstreamTLS([]UpstreamTLSRule{{CipherSuites: []string{"TLS_NOPE"}}}, nil)
+	if err == nil {
+		t.Fatal("unknown cipher suite accepted")
+	}
+
+	u, err := NewUpstreamTLS([]UpstreamTLSRule{
+		{Host: "127.0.0.1", RootCAs: []string{rootFile}, MinVersion: "1.2"},
+		{Host: "*", InsecureSkipVerify: true, CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := u.Config("example.com:443", "example.com"); !c.InsecureSkipVerify || len(c.CipherSuites) != 1 {
+		t.Fatalf("wildcard rule not applied: %+v", c)
+	}
+
+	addr := srv.Listener.Addr().String()
+	conn, err := tls.Dial("tcp", addr, u.Config(addr, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+
+	if v := u.Verify(addr, &state); !v.Verified || v.SkipVerify || v.Version == "" {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+	if v := u.Verify("localhost:1", &state); v.Verified || !v.SkipVerify || v.Error == "" {
+		t.Fatalf("unexpected verification %+v", v)
+	}
+}
+
+func TestUpstreamTLSDial(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		rules []UpstreamTLSRule
+		ok    bool
+	}{
+		{nil, false},
+		{[]UpstreamTLSRule{{Host: "127.0.0.1", InsecureSkipVerify: true}}, true},
+	} {
+		u, err := NewUpstreamTLS(tc.rules, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{DialTLS: u.DialTLS}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("rules %+v: %v", tc.rules, err)
+		}
+	}
+}
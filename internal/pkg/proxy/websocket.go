@@ -0,0 +1,490 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Senders of WebSocket frames.
+const (
+	DirectionClient = "client"
+	DirectionServer = "server"
+)
+
+// maxFramePayload limits the payload saved per frame, longer ones are
+// truncated in the record but passed on whole.
+const maxFramePayload = 1 << 20
+
+// WebSocketFrame is a frame of a proxied WebSocket. ConnectionID is the id
+// of the saved handshake request. Payload is unmasked, but compressed
+// frames (Compressed set by permessage-deflate) are saved as sent.
+// Injected frames were sent through the API, not by the peer. Queued is
+// only reported for injected frames which wait for the end of a message
+// in their direction; they are saved once sent.
+type WebSocketFrame struct {
+	ID           bson.ObjectId `bson:"_id" json:"id"`
+	ConnectionID bson.ObjectId `bson:"connection_id" json:"connection_id"`
+	Direction    string        `bson:"direction" json:"direction"`
+	Time         time.Time     `bson:"time" json:"time"`
+	Opcode       int           `bson:"opcode" json:"opcode"`
+	Fin          bool          `bson:"fin" json:"fin"`
+	Compressed   bool          `bson:"compressed,omitempty" json:"compressed,omitempty"`
+	Length       int64         `bson:"length" json:"length"`
+	Truncated    bool          `bson:"truncated,omitempty" json:"truncated,omitempty"`
+	Injected     bool          `bson:"injected,omitempty" json:"injected,omitempty"`
+	Queued       bool          `bson:"-" json:"queued,omitempty"`
+	Payload      []byte        `bson:"payload" json:"payload"`
+}
+
+// IsWebSocketUpgrade reports whether h asks for or accepts a WebSocket.
+func IsWebSocketUpgrade(h http.Header) bool {
+	return strings.EqualFold(h.Get("Upgrade"), "websocket") &&
+		headerHasToken(h, "Connection", "upgrade")
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// A frameParser follows a stream of frames sent in one direction and
+// calls onFrame for each complete one.
+type frameParser struct {
+	onFrame func(f *WebSocketFrame)
+	// fragmented is set inside a message sent in several frames, which
+	// other data frames must not interrupt.
+	fragmented bool
+
+	header  []byte
+	frame   *WebSocketFrame
+	left    int64
+	masked  bool
+	mask    [4]byte
+	maskPos int
+}
+
+// headerLen returns the length of the frame header starting with b, which
+// has at least 2 bytes.
+func headerLen(b []byte) int {
+	n := 2
+	switch b[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if b[1]&0x80 != 0 {
+		n += 4
+	}
+
+	return n
+}
+
+func (p *frameParser) Write(b []byte) (int, error) {
+	written := len(b)
+	for len(b) > 0 {
+		if p.frame == nil {
+			b = p.readHeader(b)
+			continue
+		}
+
+		n := int64(len(b))
+		if n > p.left {
+			n = p.left
+		}
+		chunk := b[:n]
+		b = b[n:]
+		p.left -= n
+
+		if room := maxFramePayload - len(p.frame.Payload); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			start := len(p.frame.Payload)
+			p.frame.Payload = append(p.frame.Payload, chunk...)
+			if p.masked {
+				for i := start; i < len(p.frame.Payload); i++ {
+					p.frame.Payload[i] ^= p.mask[p.maskPos%4]
+					p.maskPos++
+				}
+			}
+		}
+		if p.left == 0 {
+			p.done()
+		}
+	}
+
+	return written, nil
+}
+
+func (p *frameParser) readHeader(b []byte) []byte {
+	need := 2
+	if len(p.header) >= 2 {
+		need = headerLen(p.header)
+	}
+	for len(p.header) < need && len(b) > 0 {
+		p.header = append(p.header, b[0])
+		b = b[1:]
+		if len(p.header) == 2 {
+			need = headerLen(p.header)
+		}
+	}
+	if len(p.header) < need {
+		return b
+	}
+
+	h := p.header
+	f := &WebSocketFrame{
+		Time:       time.Now(),
+		Fin:        h[0]&0x80 != 0,
+		Compressed: h[0]&0x40 != 0,
+		Opcode:     int(h[0] & 0x0f),
+		Payload:    []byte{},
+	}
+	rest := h[2:]
+	switch h[1] & 0x7f {
+	case 126:
+		f.Length = int64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		f.Length = int64(binary.BigEndian.Uint64(rest) & (1<<63 - 1))
+		rest = rest[8:]
+	default:
+		f.Length = int64(h[1] & 0x7f)
+	}
+	if f.Opcode < opcodeClose {
+		p.fragmented = !f.Fin
+	}
+	p.masked = h[1]&0x80 != 0
+	if p.masked {
+		copy(p.mask[:], rest)
+	}
+	p.maskPos = 0
+	p.header = p.header[:0]
+	p.frame = f
+	p.left = f.Length
+	if p.left == 0 {
+		p.done()
+	}
+
+	return b
+}
+
+// idle reports whether the stream is between frames.
+func (p *frameParser) idle() bool {
+	return p.frame == nil && len(p.header) == 0
+}
+
+// accepts reports whether a frame with opcode can be put into the stream
+// now. Control frames may go between fragments of a message, data frames
+// only between messages.
+func (p *frameParser) accepts(opcode int) bool {
+	return p.idle() && (opcode >= opcodeClose || !p.fragmented)
+}
+
+func (p *frameParser) done() {
+	f := p.frame
+	p.frame = nil
+	f.Truncated = int64(len(f.Payload)) < f.Length
+	p.onFrame(f)
+}
+
+// A queuedFrame is an injected frame waiting for the stream to accept it.
+type queuedFrame struct {
+	frame *WebSocketFrame
+	data  []byte
+}
+
+// wsConn passes the upgraded upstream connection through, recording the
+// frames read from the server and written by the client. Frames injected
+// into either direction are sent between the proxied ones, so the upstream
+// is read by pump and the client reads the pipe.
+type wsConn struct {
+	upstream io.ReadWriteCloser
+	id       string
+	save     func(f *WebSocketFrame)
+	onClose  func()
+
+	toClient *io.PipeReader
+
+	// readMu guards what goes to the client and the server parser.
+	readMu      sync.Mutex
+	pipe        *io.PipeWriter
+	server      *frameParser
+	clientQueue []*queuedFrame
+
+	// writeMu guards what goes to the upstream and the client parser.
+	writeMu     sync.Mutex
+	client      *frameParser
+	serverQueue []*queuedFrame
+
+	closeOnce sync.Once
+}
+
+func (c *wsConn) pump() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := c.upstream.Read(buf)
+		if n > 0 {
+			c.readMu.Lock()
+			_, werr := c.pipe.Write(buf[:n])
+			_, _ = c.server.Write(buf[:n])
+			if werr == nil {
+				werr = c.flush(c.pipe, c.server, &c.clientQueue)
+			}
+			c.readMu.Unlock()
+			if werr != nil {
+				c.upstream.Close()
+				return
+			}
+		}
+		if err != nil {
+			c.pipe.CloseWithError(err)
+			return
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	return c.toClient.Read(b)
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.upstream.Write(b)
+	if n > 0 {
+		_, _ = c.client.Write(b[:n])
+	}
+	if err == nil {
+		err = c.flush(c.upstream, c.client, &c.serverQueue)
+	}
+
+	return n, err
+}
+
+func (c *wsConn) Close() error {
+	err := c.upstream.Close()
+	c.closeOnce.Do(func() {
+		c.toClient.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+
+	return err
+}
+
+// inject sends a frame to the client or to the server as soon as the
+// stream in that direction accepts it. A frame which has to wait is queued
+// and saved, getting its id, once sent; a copy marked Queued is returned
+// meanwhile.
+func (c *wsConn) inject(to string, f *WebSocketFrame) (*WebSocketFrame, error) {
+	var (
+		mu     *sync.Mutex
+		w      io.Writer
+		parser *frameParser
+		queue  *[]*queuedFrame
+		masked bool
+	)
+	switch to {
+	case DirectionServer:
+		f.Direction = DirectionClient
+		mu, w, parser, queue, masked = &c.writeMu, c.upstream, c.client, &c.serverQueue, true
+	case DirectionClient:
+		f.Direction = DirectionServer
+		mu, w, parser, queue = &c.readMu, c.pipe, c.server, &c.clientQueue
+	default:
+		return nil, errors.Errorf("direction must be either %s or %s", DirectionClient, DirectionServer)
+	}
+	f.ConnectionID = bson.ObjectIdHex(c.id)
+	f.Injected = true
+	data := encodeFrame(f, masked)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(*queue) > 0 || !parser.accepts(f.Opcode) {
+		*queue = append(*queue, &queuedFrame{frame: f, data: data})
+		queued := *f
+		queued.Queued = true
+		return &queued, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.Wrap(err, "can't send frame")
+	}
+	c.save(f)
+
+	return f, nil
+}
+
+// flush sends the queued frames in order while the stream accepts them.
+func (c *wsConn) flush(w io.Writer, parser *frameParser, queue *[]*queuedFrame) error {
+	for len(*queue) > 0 && parser.accepts((*queue)[0].frame.Opcode) {
+		q := (*queue)[0]
+		if _, err := w.Write(q.data); err != nil {
+			return err
+		}
+		*queue = (*queue)[1:]
+		q.frame.Time = time.Now()
+		c.save(q.frame)
+	}
+
+	return nil
+}
+
+// encodeFrame returns f on the wire, masked as clients have to send it.
+func encodeFrame(f *WebSocketFrame, masked bool) []byte {
+	b := make([]byte, 2, 14+len(f.Payload))
+	b[0] = byte(f.Opcode & 0x0f)
+	if f.Fin {
+		b[0] |= 0x80
+	}
+	if f.Compressed {
+		b[0] |= 0x40
+	}
+
+	n := len(f.Payload)
+	switch {
+	case n < 126:
+		b[1] = byte(n)
+	case n <= 0xffff:
+		b[1] = 126
+		b = append(b, 0, 0)
+		binary.BigEndian.PutUint16(b[2:], uint16(n))
+	default:
+		b[1] = 127
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[2:], uint64(n))
+	}
+
+	if !masked {
+		return append(b, f.Payload...)
+	}
+	b[1] |= 0x80
+	var mask [4]byte
+	_, _ = rand.Read(mask[:])
+	b = append(b, mask[:]...)
+	for i, c := range f.Payload {
+		b = append(b, c^mask[i%4])
+	}
+
+	return b
+}
+
+// CaptureWebSocket makes frames of an accepted WebSocket upgrade be saved
+// in store with the handshake record rs, and registers the connection in
+// sockets, if any, for injection while it is open. The handshake is saved
+// right away, so frames have their record while the connection is open,
+// and again with its duration on close.
+func CaptureWebSocket(resp *http.Response, rs *RequestSave, store Store, sockets *WebSockets, log *logrus.Logger) {
+	if resp.StatusCode != http.StatusSwitchingProtocols || !IsWebSocketUpgrade(resp.Header) {
+		return
+	}
+	body, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+
+	// The connection may be closed after the handler saving rs returned,
+	// so the handshake is saved from a copy.
+	handshake := *rs
+	handshake.Response = &ResponseSave{
+		StatusCode: resp.StatusCode,
+		Header:     cloneHeader(resp.Header),
+		Trailer:    http.Header{},
+		TTFB:       time.Since(rs.Time),
+	}
+	saveHandshake := func() {
+		if _, err := store.Save(&handshake); err != nil {
+			log.WithError(err).WithField("id", rs.ID.Hex()).Error("can't save websocket handshake")
+		}
+	}
+	saveHandshake()
+
+	save := func(f *WebSocketFrame) {
+		if f.ID == "" {
+			f.ID = bson.NewObjectId()
+		}
+		f.ConnectionID = rs.ID
+		err := store.SaveFrame(f)
+		if err != nil {
+			log.WithError(err).WithField("id", rs.ID.Hex()).Error("can't save websocket frame")
+		}
+	}
+	saveFrom := func(direction string) func(f *WebSocketFrame) {
+		return func(f *WebSocketFrame) {
+			f.Direction = direction
+			save(f)
+		}
+	}
+
+	pr, pw := io.Pipe()
+	conn := &wsConn{
+		upstream: body,
+		id:       rs.ID.Hex(),
+		save:     save,
+		toClient: pr,
+		pipe:     pw,
+		server:   &frameParser{onFrame: saveFrom(DirectionServer)},
+		client:   &frameParser{onFrame: saveFrom(DirectionClient)},
+	}
+	if sockets != nil {
+		sockets.add(conn)
+	}
+	conn.onClose = func() {
+		if sockets != nil {
+			sockets.remove(conn.id)
+		}
+		handshake.Response.Duration = time.Since(rs.Time)
+		saveHandshake()
+	}
+	go conn.pump()
+
+	resp.Body = conn
+}
+
+// GetFramesHandler returns handler for GET /requests/{id}/frames, which
+// lists frames of the WebSocket opened by the request in order. It accepts
+// offset and limit.
+func GetFramesHandler(store Store) func(res http.ResponseWriter, req *http.Request) {
+	return func(res http.ResponseWriter, req *http.Request) {
+		log := getTraceLogger(req.Context())
+		id := mux.Vars(req)["id"]
+
+		opts, err := parseListOptions(req.URL.Query())
+		if err != nil {
+			ErrResponse(res, http.StatusBadRequest, err.Error())
+
+			log.WithError(err).Error("bad list options")
+			return
+		}
+
+		frames, err := store.Frames(id, opts.Offset, opts.Limit)
+		if err != nil {
+			ErrResponse(res, http.StatusInternalServerError, "can't list frames")
+
+			log.WithError(err).Error("can't list frames")
+			return
+		}
+		OkResponse(res, frames)
+	}
+}
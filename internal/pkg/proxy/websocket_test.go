@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestFrameParser(t *testing.T) {
+	var frames []*WebSocketFrame
+	p := &frameParser{onFrame: func(f *WebSocketFrame) {
+		frames = append(frames, f)
+	}}
+
+	// masked "Hello" from a client, then an unmasked 200 byte binary frame
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	stream := []byte{0x81, 0x85}
+	stream = append(stream, mask...)
+	for i, c := range []byte("Hello") {
+		stream = append(stream, c^mask[i%4])
+	}
+	long := bytes.Repeat([]byte{7}, 200)
+	stream = append(stream, 0x82, 126, 0, 200)
+	stream = append(stream, long...)
+
+	// one byte at a time, as reads may split frames anywhere
+	for i := range stream {
+		_, _ = p.Write(stream[i : i+1])
+	}
+
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames", len(frames))
+	}
+	if f := frames[0]; f.Opcode != 1 || !f.Fin || string(f.Payload) != "Hello" {
+		t.Errorf("bad text frame %+v", f)
+	}
+	if f := frames[1]; f.Opcode != 2 || f.Length != 200 || !bytes.Equal(f.Payload, long) {
+		t.Errorf("bad binary frame %+v", f)
+	}
+}
+
+func TestEncodeFrame(t *testing.T) {
+	var got *WebSocketFrame
+	p := &frameParser{onFrame: func(f *WebSocketFrame) {
+		got = f
+	}}
+
+	for _, size := range []int{0, 125, 126, 70000} {
+		sent := &WebSocketFrame{Opcode: 2, Fin: true, Payload: bytes.Repeat([]byte{'a'}, size)}
+		for _, masked := range []bool{false, true} {
+			got = nil
+			_, _ = p.Write(encodeFrame(sent, masked))
+			if got == nil || got.Length != int64(size) || !bytes.Equal(got.Payload, sent.Payload) {
+				t.Errorf("size %d, masked %v: got %+v", size, masked, got)
+			}
+		}
+	}
+}
+
+func tempBoltStore(t *testing.T) (*BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "websocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewBoltStore(filepath.Join(dir, "history.db"), time.Second)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// A frameCollector parses the frames read from one side of a connection.
+type frameCollector struct {
+	mu     sync.Mutex
+	frames []*WebSocketFrame
+}
+
+func collectFrames(r io.Reader) *frameCollector {
+	c := &frameCollector{}
+	p := &frameParser{onFrame: func(f *WebSocketFrame) {
+		c.mu.Lock()
+		c.frames = append(c.frames, f)
+		c.mu.Unlock()
+	}}
+	go func() {
+		_, _ = io.Copy(p, r)
+	}()
+
+	return c
+}
+
+func (c *frameCollector) wait(t *testing.T, n int) []*WebSocketFrame {
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(5 * time.Millisecond) {
+		c.mu.Lock()
+		frames := c.frames
+		c.mu.Unlock()
+		if len(frames) >= n {
+			return frames
+		}
+	}
+	t.Fatalf("%d frames aren't read", n)
+
+	return nil
+}
+
+func payloads(frames []*WebSocketFrame) string {
+	res := make([]string, 0, len(frames))
+	for _, f := range frames {
+		res = append(res, string(f.Payload))
+	}
+
+	return strings.Join(res, ",")
+}
+
+func TestWebSocketInject(t *testing.T) {
+	store, cleanup := tempBoltStore(t)
+	defer cleanup()
+
+	server, upstream := net.Pipe()
+	defer server.Close()
+	rs := &RequestSave{ID: bson.NewObjectId(), Time: time.Now(), URL: &url.URL{Path: "/"}}
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		Header:     http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}},
+		Body:       upstream,
+	}
+	sockets := NewWebSockets()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	CaptureWebSocket(resp, rs, store, sockets, log)
+	conn := resp.Body.(*wsConn)
+	defer conn.Close()
+	id := rs.ID.Hex()
+	text := func(s string) *string { return &s }
+
+	toClient := collectFrames(conn)
+	toServer := collectFrames(server)
+
+	// A data frame waits for the end of a fragmented message from the
+	// server, a ping goes between its fragments.
+	_, _ = server.Write(encodeFrame(&WebSocketFrame{Opcode: opcodeText, Payload: []byte("hel")}, false))
+	toClient.wait(t, 1)
+	f, err := sockets.Inject(id, &WebSocketMessage{To: DirectionClient, Opcode: 9, Payload: text("ping")})
+	if err != nil || f.Queued || f.ID == "" {
+		t.Fatalf("ping: %+v, %v", f, err)
+	}
+	f, err = sockets.Inject(id, &WebSocketMessage{To: DirectionClient, Payload: text("injected")})
+	if err != nil || !f.Queued || f.ID != "" || f.Direction != DirectionServer {
+		t.Fatalf("text: %+v, %v", f, err)
+	}
+	saved, err := store.Frames(id, 0, 0)
+	if err != nil || len(saved) != 2 {
+		t.Errorf("queued frame saved: %s, %v", payloads(saved), err)
+	}
+	_, _ = server.Write(encodeFrame(&WebSocketFrame{Opcode: 0, Fin: true, Payload: []byte("lo")}, false))
+	if got := payloads(toClient.wait(t, 4)); got != "hel,ping,lo,injected" {
+		t.Errorf("client got %s", got)
+	}
+
+	// The same for a fragmented message from the client.
+	_, _ = conn.Write(encodeFrame(&WebSocketFrame{Opcode: opcodeBinary, Payload: []byte("a")}, true))
+	f, err = sockets.Inject(id, &WebSocketMessage{To: DirectionServer, Payload: text("x")})
+	if err != nil || !f.Queued || f.Direction != DirectionClient {
+		t.Fatalf("to server: %+v, %v", f, err)
+	}
+	_, _ = conn.Write(encodeFrame(&WebSocketFrame{Opcode: 0, Fin: true, Payload: []byte("b")}, true))
+	if got := payloads(toServer.wait(t, 3)); got != "a,b,x" {
+		t.Errorf("server got %s", got)
+	}
+
+	saved, err = store.Frames(id, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := payloads(saved); got != "hel,ping,lo,injected,a,b,x" {
+		t.Errorf("saved %s", got)
+	}
+	injected := map[string]bool{"ping": true, "injected": true, "x": true}
+	for _, f := range saved {
+		if f.Injected != injected[string(f.Payload)] {
+			t.Errorf("frame %q injected %v", f.Payload, f.Injected)
+		}
+	}
+}
+
+func TestReplayWebSocket(t *testing.T) {
+	upstream := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	}))
+	defer upstream.Close()
+
+	store, cleanup := tempBoltStore(t)
+	defer cleanup()
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	u, _ := url.Parse(upstream.URL)
+	saved := &RequestSave{
+		Method: http.MethodGet,
+		URL:    &url.URL{Scheme: "http", Host: u.Host, Path: "/echo"},
+		Host:   u.Host,
+		Proto:  "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-Websocket-Version": {"13"},
+			"Sec-Websocket-Key":     {newWebSocketKey()},
+			"Origin":                {upstream.URL},
+		},
+		Response: &ResponseSave{StatusCode: http.StatusSwitchingProtocols},
+	}
+	if _, err := store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*WebSocketFrame{
+		{Direction: DirectionClient, Opcode: opcodeText, Fin: true, Payload: []byte("one")},
+		{Direction: DirectionServer, Opcode: opcodeText, Fin: true, Payload: []byte("one")},
+		{Direction: DirectionClient, Opcode: opcodeText, Fin: true, Payload: []byte("two")},
+	} {
+		f.ConnectionID = saved.ID
+		if err := store.SaveFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rs, err := ReplayWebSocket(http.DefaultClient, store, NewWebSockets(), saved.ID.Hex(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.ParentID != saved.ID || rs.ID == saved.ID || rs.Response.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("replayed record %+v", rs)
+	}
+	if _, err = store.Get(rs.ID.Hex()); err != nil {
+		t.Errorf("replayed record isn't saved: %v", err)
+	}
+
+	frames, err := store.Frames(rs.ID.Hex(), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string][]string{}
+	for _, f := range frames {
+		if f.Opcode == opcodeText {
+			got[f.Direction] = append(got[f.Direction], string(f.Payload))
+		}
+	}
+	if strings.Join(got[DirectionClient], ",") != "one,two" || strings.Join(got[DirectionServer], ",") != "one,two" {
+		t.Errorf("replayed frames %v", got)
+	}
+	if !hasOpcode(frames, DirectionClient, opcodeClose) {
+		t.Error("replay isn't closed")
+	}
+
+	if _, err = ReplayWebSocket(http.DefaultClient, store, nil, bson.NewObjectId().Hex(), log); err != ErrNotFound {
+		t.Errorf("unknown id: %v", err)
+	}
+	saved.Response.StatusCode = http.StatusOK
+	if _, err = store.Save(saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReplayWebSocket(http.DefaultClient, store, nil, saved.ID.Hex(), log); err != ErrNotWebSocket {
+		t.Errorf("not a websocket: %v", err)
+	}
+}
+
+func hasOpcode(frames []*WebSocketFrame, direction string, opcode int) bool {
+	for _, f := range frames {
+		if f.Direction == direction && f.Opcode == opcode {
+			return true
+		}
+	}
+
+	return false
+}
@@ -5,4 +5,4 @@ cat config.yaml
 
 docker-compose up -d --build "$@"
 
-go run cmd/proxy/main.go
\ No newline at end of file
+go run ./cmd/proxy
\ No newline at end of file